@@ -0,0 +1,9 @@
+package docs
+
+import _ "embed"
+
+// WebSocketSchema is the JSON Schema of the /ws envelope protocol. It is
+// maintained by hand alongside handlers/protocol.go.
+//
+//go:embed websocket.schema.json
+var WebSocketSchema []byte
@@ -1,41 +1,141 @@
 package handlers
 
 import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "log"
     "net/http"
     "quickstart/models"
-    
+    "time"
+
     "github.com/gin-gonic/gin"
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/gorm"
+)
+
+const (
+    minPasswordLength = 8
+    // bcrypt ignores everything after the first 72 bytes.
+    maxPasswordLength = 72
+
+    invalidCredentialsMessage = "Invalid name or password"
 )
 
+// dummyPasswordHash is compared against when the user does not exist so
+// that unknown names take as long to reject as wrong passwords.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
 type AuthHandler struct {
-    userRepo models.UserRepository
+    userRepo    models.UserRepository
+    refreshRepo models.RefreshTokenRepository
+    tokens      *TokenManager
 }
 
 type LoginRequest struct {
-    Name string `json:"name" binding:"required"`
+    Name     string `json:"name" binding:"required"`
+    Password string `json:"password" binding:"required"`
+}
+
+type RegisterRequest struct {
+    Name     string `json:"name" binding:"required"`
+    Email    string `json:"email" binding:"required,email"`
+    Password string `json:"password" binding:"required"`
+}
+
+type SetupPasswordRequest struct {
+    SetupToken string `json:"setup_token" binding:"required"`
+    Password   string `json:"password" binding:"required"`
+}
+
+type RefreshRequest struct {
+    RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
 type LoginResponse struct {
     Success bool         `json:"success"`
     Message string       `json:"message"`
     User    *models.User `json:"user,omitempty"`
+
+    AccessToken  string `json:"access_token,omitempty"`
+    RefreshToken string `json:"refresh_token,omitempty"`
+    TokenType    string `json:"token_type,omitempty"`
+    // ExpiresIn is the access token lifetime in seconds.
+    ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+func NewAuthHandler(userRepo models.UserRepository, refreshRepo models.RefreshTokenRepository, tokens *TokenManager) *AuthHandler {
+    return &AuthHandler{userRepo: userRepo, refreshRepo: refreshRepo, tokens: tokens}
 }
 
-func NewAuthHandler(userRepo models.UserRepository) *AuthHandler {
-    return &AuthHandler{userRepo: userRepo}
+// Register godoc
+// @Summary Register a new user
+// @Schemes
+// @Description Create a user account with a password
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param register body RegisterRequest true "Account details"
+// @Success 201 {object} LoginResponse
+// @Failure 400 {object} LoginResponse
+// @Failure 409 {object} LoginResponse
+// @Router /auth/register [post]
+func (h *AuthHandler) Register(c *gin.Context) {
+    var req RegisterRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, LoginResponse{
+            Success: false,
+            Message: "Invalid request: " + err.Error(),
+        })
+        return
+    }
+
+    if msg := validatePassword(req.Password); msg != "" {
+        c.JSON(http.StatusBadRequest, LoginResponse{Success: false, Message: msg})
+        return
+    }
+
+    if _, err := h.userRepo.FindByName(req.Name); err != gorm.ErrRecordNotFound {
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+            return
+        }
+        c.JSON(http.StatusConflict, LoginResponse{Success: false, Message: "Name is already taken"})
+        return
+    }
+    if _, err := h.userRepo.FindByEmail(req.Email); err != gorm.ErrRecordNotFound {
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+            return
+        }
+        c.JSON(http.StatusConflict, LoginResponse{Success: false, Message: "Email is already registered"})
+        return
+    }
+
+    user := models.User{Name: req.Name, Email: req.Email}
+    if err := user.SetPassword(req.Password); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Failed to hash password"})
+        return
+    }
+    if err := h.userRepo.Create(&user); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+
+    h.respondWithTokens(c, http.StatusCreated, "Registration successful", &user, "")
 }
 
 // Login godoc
-// @Summary Login user by name
+// @Summary Login user
 // @Schemes
-// @Description Login user using their name
+// @Description Login using name and password. Every failure, including accounts that have no password yet, gets the same 401.
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Param login body LoginRequest true "Login credentials"
 // @Success 200 {object} LoginResponse
 // @Failure 400 {object} LoginResponse
-// @Failure 404 {object} LoginResponse
+// @Failure 401 {object} LoginResponse
 // @Router /auth/login [post]
 func (h *AuthHandler) Login(c *gin.Context) {
     var req LoginRequest
@@ -47,36 +147,299 @@ func (h *AuthHandler) Login(c *gin.Context) {
         return
     }
 
-    // Find user by name
-    users, err := h.userRepo.FindAll()
+    user, err := h.userRepo.FindByName(req.Name)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, LoginResponse{
+        if err != gorm.ErrRecordNotFound {
+            c.JSON(http.StatusInternalServerError, LoginResponse{
+                Success: false,
+                Message: "Database error",
+            })
+            return
+        }
+        // Burn the same time as a real comparison before rejecting.
+        bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+        c.JSON(http.StatusUnauthorized, LoginResponse{
+            Success: false,
+            Message: invalidCredentialsMessage,
+        })
+        return
+    }
+
+    if !user.HasPassword() {
+        // Accounts created before passwords existed need a setup token
+        // from an administrator; answer as for a wrong password so names
+        // cannot be probed.
+        bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+    }
+    if !user.CheckPassword(req.Password) {
+        c.JSON(http.StatusUnauthorized, LoginResponse{
+            Success: false,
+            Message: invalidCredentialsMessage,
+        })
+        return
+    }
+
+    h.respondWithTokens(c, http.StatusOK, "Login successful", user, "")
+}
+
+// SetupPassword godoc
+// @Summary Set password with a setup token
+// @Schemes
+// @Description Set the password of an account using a setup token issued by an administrator with the password-setup command and handed to the account owner out of band. Used for accounts created before passwords existed and for password resets.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param setup body SetupPasswordRequest true "Setup token and new password"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} LoginResponse
+// @Failure 401 {object} LoginResponse
+// @Router /auth/password/setup [post]
+func (h *AuthHandler) SetupPassword(c *gin.Context) {
+    var req SetupPasswordRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, LoginResponse{
+            Success: false,
+            Message: "Invalid request: " + err.Error(),
+        })
+        return
+    }
+
+    if msg := validatePassword(req.Password); msg != "" {
+        c.JSON(http.StatusBadRequest, LoginResponse{Success: false, Message: msg})
+        return
+    }
+
+    user, err := h.userRepo.FindByPasswordSetupToken(hashToken(req.SetupToken))
+    if err != nil && err != gorm.ErrRecordNotFound {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+    if err == gorm.ErrRecordNotFound ||
+        user.PasswordSetupExpiresAt == nil || time.Now().After(*user.PasswordSetupExpiresAt) {
+        c.JSON(http.StatusUnauthorized, LoginResponse{Success: false, Message: "Invalid or expired setup token"})
+        return
+    }
+
+    if err := user.SetPassword(req.Password); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Failed to hash password"})
+        return
+    }
+    user.PasswordSetupTokenHash = ""
+    user.PasswordSetupExpiresAt = nil
+    if err := h.userRepo.Update(user); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+    // Sessions opened with the old password end with it.
+    if err := h.refreshRepo.RevokeUser(user.ID); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+
+    h.respondWithTokens(c, http.StatusOK, "Password set", user, "")
+}
+
+// Refresh godoc
+// @Summary Refresh access token
+// @Schemes
+// @Description Exchange a refresh token for a new access and refresh token pair. Each refresh token can be used once; reusing one revokes every token issued from the same login.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param refresh body RefreshRequest true "Refresh token"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} LoginResponse
+// @Failure 401 {object} LoginResponse
+// @Router /auth/refresh [post]
+func (h *AuthHandler) Refresh(c *gin.Context) {
+    var req RefreshRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, LoginResponse{
             Success: false,
-            Message: "Database error",
+            Message: "Invalid request: " + err.Error(),
         })
         return
     }
 
-    // Search for user with matching name
-    var foundUser *models.User
-    for _, user := range users {
-        if user.Name == req.Name {
-            foundUser = &user
-            break
+    token, err := h.refreshRepo.FindByHash(hashToken(req.RefreshToken))
+    if err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusUnauthorized, LoginResponse{Success: false, Message: "Invalid refresh token"})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+
+    if token.RevokedAt != nil {
+        h.revokeReusedFamily(c, token)
+        return
+    }
+    if time.Now().After(token.ExpiresAt) {
+        c.JSON(http.StatusUnauthorized, LoginResponse{Success: false, Message: "Refresh token expired"})
+        return
+    }
+
+    revoked, err := h.refreshRepo.Revoke(token.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+    if !revoked {
+        // Another request used the token between our read and write.
+        h.revokeReusedFamily(c, token)
+        return
+    }
+
+    user, err := h.userRepo.FindByID(token.UserID)
+    if err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusUnauthorized, LoginResponse{Success: false, Message: "Invalid refresh token"})
+            return
         }
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
     }
 
-    if foundUser == nil {
-        c.JSON(http.StatusNotFound, LoginResponse{
+    h.respondWithTokens(c, http.StatusOK, "Token refreshed", user, token.FamilyID)
+}
+
+// Logout godoc
+// @Summary Logout
+// @Schemes
+// @Description Revoke the refresh token and every token rotated from the same login
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param logout body RefreshRequest true "Refresh token"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} LoginResponse
+// @Router /auth/logout [post]
+func (h *AuthHandler) Logout(c *gin.Context) {
+    var req RefreshRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, LoginResponse{
             Success: false,
-            Message: "User not found",
+            Message: "Invalid request: " + err.Error(),
         })
         return
     }
 
-    c.JSON(http.StatusOK, LoginResponse{
-        Success: true,
-        Message: "Login successful",
-        User:    foundUser,
+    token, err := h.refreshRepo.FindByHash(hashToken(req.RefreshToken))
+    if err != nil && err != gorm.ErrRecordNotFound {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+    if err == nil {
+        if err := h.refreshRepo.RevokeFamily(token.FamilyID); err != nil {
+            c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+            return
+        }
+    }
+
+    // Unknown tokens are treated as already logged out.
+    c.JSON(http.StatusOK, LoginResponse{Success: true, Message: "Logged out"})
+}
+
+// respondWithTokens issues an access token and a refresh token in
+// familyID (a new family when empty) and writes the login response.
+func (h *AuthHandler) respondWithTokens(c *gin.Context, status int, message string, user *models.User, familyID string) {
+    accessToken, err := h.tokens.IssueAccessToken(user.ID)
+    if err != nil {
+        log.Println("Failed to sign access token:", err)
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Internal error"})
+        return
+    }
+
+    refreshToken, err := generateToken()
+    if err == nil && familyID == "" {
+        familyID, err = generateToken()
+    }
+    if err != nil {
+        log.Println("Failed to generate refresh token:", err)
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Internal error"})
+        return
+    }
+
+    if err := h.refreshRepo.Create(&models.RefreshToken{
+        UserID:    user.ID,
+        FamilyID:  familyID,
+        TokenHash: hashToken(refreshToken),
+        ExpiresAt: time.Now().Add(h.tokens.refreshTTL),
+    }); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+
+    c.JSON(status, LoginResponse{
+        Success:      true,
+        Message:      message,
+        User:         user,
+        AccessToken:  accessToken,
+        RefreshToken: refreshToken,
+        TokenType:    "Bearer",
+        ExpiresIn:    int(h.tokens.accessTTL.Seconds()),
     })
-}
\ No newline at end of file
+}
+
+// revokeReusedFamily handles a refresh token that was presented after it
+// had already been used: the token has leaked, so every session derived
+// from the same login is revoked.
+func (h *AuthHandler) revokeReusedFamily(c *gin.Context, token *models.RefreshToken) {
+    log.Printf("Refresh token reuse detected for user %d, revoking family", token.UserID)
+    if err := h.refreshRepo.RevokeFamily(token.FamilyID); err != nil {
+        c.JSON(http.StatusInternalServerError, LoginResponse{Success: false, Message: "Database error"})
+        return
+    }
+    c.JSON(http.StatusUnauthorized, LoginResponse{Success: false, Message: "Invalid refresh token"})
+}
+
+// IssuePasswordSetupToken gives the user named name a setup token for
+// /auth/password/setup valid for ttl, replacing any earlier one. It is
+// for administrators, who hand the token to the account owner.
+func IssuePasswordSetupToken(userRepo models.UserRepository, name string, ttl time.Duration) (string, error) {
+    user, err := userRepo.FindByName(name)
+    if err != nil {
+        return "", err
+    }
+
+    token, err := generateToken()
+    if err != nil {
+        return "", err
+    }
+    expiresAt := time.Now().Add(ttl)
+    user.PasswordSetupTokenHash = hashToken(token)
+    user.PasswordSetupExpiresAt = &expiresAt
+    if err := userRepo.Update(user); err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+// validatePassword returns a user-facing message when password is not
+// acceptable, or an empty string.
+func validatePassword(password string) string {
+    if len(password) < minPasswordLength {
+        return "Password must be at least 8 characters"
+    }
+    if len(password) > maxPasswordLength {
+        return "Password must be at most 72 bytes"
+    }
+    return ""
+}
+
+// generateToken returns a random opaque token suitable for URLs.
+func generateToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// hashToken is how opaque tokens are stored, so a database leak does not
+// expose usable tokens.
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+// Broker channels shared by every instance.
+const (
+	brokerRoomChannel     = "rooms"
+	brokerPresenceChannel = "presence"
+)
+
+// BrokerMessage is a payload received on a broker channel.
+type BrokerMessage struct {
+	Channel string
+	Payload []byte
+}
+
+// Broker is the pub/sub backplane that lets several instances of the
+// server share rooms. Every message published on a channel is delivered to
+// every subscriber of that channel, including the publishing instance.
+type Broker interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe delivers the messages of the channels until ctx is done.
+	Subscribe(ctx context.Context, channels ...string) (<-chan BrokerMessage, error)
+	Close() error
+}
+
+// memoryBroker is the single-instance Broker used when no backplane is
+// configured.
+type memoryBroker struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[chan BrokerMessage]bool
+}
+
+func NewMemoryBroker() Broker {
+	return &memoryBroker{subscribers: make(map[string]map[chan BrokerMessage]bool)}
+}
+
+// Publish blocks until every subscriber accepted the message, which keeps
+// the ordering and delivery guarantees of the hub's own broadcast channel.
+func (b *memoryBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subscribers[channel] {
+		select {
+		case ch <- BrokerMessage{Channel: channel, Payload: payload}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, channels ...string) (<-chan BrokerMessage, error) {
+	ch := make(chan BrokerMessage, 256)
+
+	b.mu.Lock()
+	for _, channel := range channels {
+		if b.subscribers[channel] == nil {
+			b.subscribers[channel] = make(map[chan BrokerMessage]bool)
+		}
+		b.subscribers[channel][ch] = true
+	}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		for _, channel := range channels {
+			delete(b.subscribers[channel], ch)
+		}
+		b.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
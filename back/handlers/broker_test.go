@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"quickstart/models"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const brokerTestTimeout = 2 * time.Second
+
+// brokerFactories returns constructors for every Broker implementation.
+// Brokers made by the same factory share one backplane, like several
+// instances of the server.
+func brokerFactories(t *testing.T) map[string]func(prefix string) Broker {
+	memory := NewMemoryBroker()
+	server := miniredis.RunT(t)
+	return map[string]func(string) Broker{
+		"memory": func(string) Broker { return memory },
+		"redis": func(prefix string) Broker {
+			broker, err := NewRedisBroker("redis://"+server.Addr(), prefix)
+			if err != nil {
+				t.Fatalf("NewRedisBroker: %v", err)
+			}
+			t.Cleanup(func() { broker.Close() })
+			return broker
+		},
+	}
+}
+
+func subscribe(t *testing.T, broker Broker, channels ...string) <-chan BrokerMessage {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	messages, err := broker.Subscribe(ctx, channels...)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return messages
+}
+
+func expectMessage(t *testing.T, messages <-chan BrokerMessage, channel string, payload string) {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		if msg.Channel != channel || string(msg.Payload) != payload {
+			t.Fatalf("got %q on %q, want %q on %q", msg.Payload, msg.Channel, payload, channel)
+		}
+	case <-time.After(brokerTestTimeout):
+		t.Fatalf("no message %q on %q", payload, channel)
+	}
+}
+
+func expectNoMessage(t *testing.T, messages <-chan BrokerMessage) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message %q on %q", msg.Payload, msg.Channel)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBrokerFanOut(t *testing.T) {
+	for name, newBroker := range brokerFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			publisher, other := newBroker("test:"), newBroker("test:")
+			own := subscribe(t, publisher, brokerRoomChannel)
+			remote := subscribe(t, other, brokerRoomChannel, brokerPresenceChannel)
+
+			if err := publisher.Publish(context.Background(), brokerRoomChannel, []byte("hello")); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			expectMessage(t, own, brokerRoomChannel, "hello")
+			expectMessage(t, remote, brokerRoomChannel, "hello")
+
+			if err := publisher.Publish(context.Background(), brokerPresenceChannel, []byte("away")); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			expectMessage(t, remote, brokerPresenceChannel, "away")
+			expectNoMessage(t, own)
+		})
+	}
+}
+
+func TestBrokerPreservesOrder(t *testing.T) {
+	for name, newBroker := range brokerFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			broker := newBroker("test:")
+			messages := subscribe(t, broker, brokerRoomChannel)
+
+			payloads := []string{"1", "2", "3", "4", "5"}
+			for _, payload := range payloads {
+				if err := broker.Publish(context.Background(), brokerRoomChannel, []byte(payload)); err != nil {
+					t.Fatalf("Publish: %v", err)
+				}
+			}
+			for _, payload := range payloads {
+				expectMessage(t, messages, brokerRoomChannel, payload)
+			}
+		})
+	}
+}
+
+func TestBrokerSubscriptionEndsWithContext(t *testing.T) {
+	for name, newBroker := range brokerFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			broker := newBroker("test:")
+			ctx, cancel := context.WithCancel(context.Background())
+			messages, err := broker.Subscribe(ctx, brokerRoomChannel)
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			cancel()
+
+			deadline := time.After(brokerTestTimeout)
+			for {
+				select {
+				case _, ok := <-messages:
+					if !ok {
+						return
+					}
+				case <-deadline:
+					t.Fatal("subscription still open after its context was cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestRedisBrokerPrefixIsolatesDeployments(t *testing.T) {
+	newBroker := brokerFactories(t)["redis"]
+	a, b := newBroker("a:"), newBroker("b:")
+	messagesA := subscribe(t, a, brokerRoomChannel)
+	messagesB := subscribe(t, b, brokerRoomChannel)
+
+	if err := a.Publish(context.Background(), brokerRoomChannel, []byte("only a")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	expectMessage(t, messagesA, brokerRoomChannel, "only a")
+	expectNoMessage(t, messagesB)
+}
+
+func TestNewRedisBrokerFailsWithoutServer(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+
+	if _, err := NewRedisBroker("redis://"+addr, "test:"); err == nil {
+		t.Fatal("NewRedisBroker succeeded without a server")
+	}
+}
+
+// hubClient registers an ephemeral client, which receives room frames
+// without affecting presence.
+func hubClient(hub *Hub, userID uint) *Client {
+	client := newClient(hub, nil, &models.User{ID: userID}, 16)
+	client.ephemeral = true
+	hub.register <- client
+	return client
+}
+
+func expectFrame(t *testing.T, client *Client, want string) {
+	t.Helper()
+	select {
+	case data := <-client.queue:
+		if string(data) != want {
+			t.Fatalf("got frame %s, want %s", data, want)
+		}
+	case <-time.After(brokerTestTimeout):
+		t.Fatalf("no frame %s", want)
+	}
+}
+
+func TestHubFanOutAcrossInstances(t *testing.T) {
+	for name, newBroker := range brokerFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			hubA := NewHub(time.Minute, newBroker("test:"))
+			hubB := NewHub(time.Minute, newBroker("test:"))
+			go hubA.Run()
+			go hubB.Run()
+
+			local, remote, kicked := hubClient(hubA, 1), hubClient(hubB, 2), hubClient(hubB, 3)
+			hubA.Join(local, 7)
+			hubB.Join(remote, 7)
+			hubB.Join(kicked, 7)
+
+			hubA.BroadcastToRoom(7, []byte(`{"n":1}`))
+			expectFrame(t, local, `{"n":1}`)
+			expectFrame(t, remote, `{"n":1}`)
+			expectFrame(t, kicked, `{"n":1}`)
+
+			hubA.RemoveFromRoom(7, 3, []byte(`{"n":2}`))
+			expectFrame(t, kicked, `{"n":2}`)
+			expectFrame(t, remote, `{"n":2}`)
+
+			hubA.BroadcastToRoom(7, []byte(`{"n":3}`))
+			expectFrame(t, remote, `{"n":3}`)
+			select {
+			case data := <-kicked.queue:
+				t.Fatalf("evicted client got frame %s", data)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if hubB.IsSubscribed(kicked, 7) {
+				t.Fatal("evicted client is still subscribed")
+			}
+		})
+	}
+}
+
+func TestHubClosesEvictedRoomScopedClients(t *testing.T) {
+	hub := NewHub(time.Minute, NewMemoryBroker())
+	go hub.Run()
+
+	stream, other := hubClient(hub, 1), hubClient(hub, 2)
+	stream.roomScoped = true
+	hub.Join(stream, 7)
+	hub.Join(other, 7)
+
+	hub.RemoveFromRoom(7, 1, []byte(`{"n":1}`))
+	expectFrame(t, stream, `{"n":1}`)
+	select {
+	case _, ok := <-stream.queue:
+		if ok {
+			t.Fatal("evicted stream got another frame")
+		}
+	case <-time.After(brokerTestTimeout):
+		t.Fatal("evicted stream was not closed")
+	}
+	expectFrame(t, other, `{"n":1}`)
+}
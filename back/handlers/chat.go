@@ -0,0 +1,456 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"quickstart/models"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxMessageLength     = 4000
+	maxClientMsgIDLength = 64
+)
+
+// chatError rejects a chat operation with one of the ErrCode* codes. It is
+// sent as an error frame over /ws and mapped to an HTTP status by REST
+// handlers. Any other error is reported as internal_error.
+type chatError struct {
+	code    string
+	message string
+}
+
+func (e *chatError) Error() string {
+	return e.message
+}
+
+func newChatError(code, message string) error {
+	return &chatError{code: code, message: message}
+}
+
+// respondChatError writes err as a JSON error response.
+func respondChatError(c *gin.Context, err error) {
+	var ce *chatError
+	if !errors.As(err, &ce) {
+		log.Println("Chat operation failed:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	status := http.StatusBadRequest
+	switch ce.code {
+	case ErrCodeNotFound:
+		status = http.StatusNotFound
+	case ErrCodeForbidden:
+		status = http.StatusForbidden
+	}
+	c.JSON(status, gin.H{"error": ce.message, "code": ce.code})
+}
+
+// ReadReceiptPayload tells a room that a member read up to MessageID.
+type ReadReceiptPayload struct {
+	UserID    uint      `json:"user_id"`
+	MessageID uint      `json:"message_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// ChatService implements the chat operations shared by the WebSocket
+// protocol and the REST API, and broadcasts their effects through the hub.
+type ChatService struct {
+	hub          *Hub
+	roomRepo     models.RoomRepository
+	messageRepo  models.MessageRepository
+	readRepo     models.ReadStateRepository
+	reactionRepo models.ReactionRepository
+	mentionRepo  models.MentionRepository
+	inviteRepo   models.InvitationRepository
+	auditRepo    models.AuditLogRepository
+	joinRepo     models.JoinRequestRepository
+	sanctionRepo models.SanctionRepository
+}
+
+func NewChatService(hub *Hub, roomRepo models.RoomRepository, messageRepo models.MessageRepository, readRepo models.ReadStateRepository, reactionRepo models.ReactionRepository, mentionRepo models.MentionRepository, inviteRepo models.InvitationRepository, auditRepo models.AuditLogRepository, joinRepo models.JoinRequestRepository, sanctionRepo models.SanctionRepository) *ChatService {
+	return &ChatService{hub: hub, roomRepo: roomRepo, messageRepo: messageRepo, readRepo: readRepo, reactionRepo: reactionRepo, mentionRepo: mentionRepo, inviteRepo: inviteRepo, auditRepo: auditRepo, joinRepo: joinRepo, sanctionRepo: sanctionRepo}
+}
+
+// requireMember fails unless the user belongs to the room.
+func (s *ChatService) requireMember(userID uint, roomID uint) error {
+	isMember, err := s.roomRepo.IsMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return newChatError(ErrCodeForbidden, "Not a member of this room")
+	}
+	return nil
+}
+
+// SendMessage stores a message from user and broadcasts it to the room,
+// or to its thread when ParentID is set. ClientMsgID, when set, makes the
+// send idempotent per user: a retry returns the message stored by the
+// first attempt without broadcasting it again.
+func (s *ChatService) SendMessage(user *models.User, roomID uint, payload ChatMessagePayload) (*models.Message, error) {
+	content, clientMsgID := strings.TrimSpace(payload.Content), payload.ClientMsgID
+	if content == "" {
+		return nil, newChatError(ErrCodeInvalidPayload, "Message content is required")
+	}
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return nil, newChatError(ErrCodeInvalidPayload, "Message content is too long")
+	}
+	if len(clientMsgID) > maxClientMsgIDLength {
+		return nil, newChatError(ErrCodeInvalidPayload, "client_msg_id is too long")
+	}
+	if err := s.requireWritable(user.ID, roomID); err != nil {
+		return nil, err
+	}
+
+	message := models.Message{RoomID: roomID, UserID: user.ID, Body: content}
+	if payload.ParentID != 0 {
+		rootID, err := s.threadRoot(roomID, payload.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		message.ParentID = &rootID
+	}
+	if clientMsgID != "" {
+		if existing, err := s.findSent(user.ID, roomID, clientMsgID); existing != nil || err != nil {
+			return existing, err
+		}
+		message.ClientMsgID = &clientMsgID
+	}
+	if err := s.messageRepo.Create(&message); err != nil {
+		// A concurrent retry may have won the race on the unique index.
+		if clientMsgID != "" {
+			if existing, findErr := s.findSent(user.ID, roomID, clientMsgID); existing != nil || findErr != nil {
+				return existing, findErr
+			}
+		}
+		return nil, err
+	}
+	message.User = user
+
+	if err := s.broadcastMessage(TypeChatMessage, &message); err != nil {
+		return nil, err
+	}
+	if message.ParentID != nil {
+		if err := s.broadcastThreadSummary(*message.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.notifyMentions(&message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// threadRoot returns the root of the thread a reply to parentID belongs
+// to. Replying to a reply continues the same thread.
+func (s *ChatService) threadRoot(roomID uint, parentID uint) (uint, error) {
+	parent, err := s.findMessage(parentID)
+	if err != nil {
+		return 0, err
+	}
+	if parent.RoomID != roomID {
+		return 0, newChatError(ErrCodeNotFound, "Message not found")
+	}
+	if parent.ParentID != nil {
+		return *parent.ParentID, nil
+	}
+	return parent.ID, nil
+}
+
+// broadcastThreadSummary tells the room that a thread got a new reply.
+func (s *ChatService) broadcastThreadSummary(rootID uint) error {
+	root, err := s.messageRepo.FindByID(rootID)
+	if err != nil {
+		return err
+	}
+	data, err := newEnvelope(TypeThreadUpdated, "", root.RoomID, ThreadSummaryPayload{
+		MessageID:   root.ID,
+		ReplyCount:  root.ReplyCount,
+		LastReplyAt: root.LastReplyAt,
+	})
+	if err != nil {
+		return err
+	}
+	s.hub.BroadcastToRoom(root.RoomID, data)
+	return nil
+}
+
+// OpenThread checks that the user may view the thread of messageID and
+// returns its root.
+func (s *ChatService) OpenThread(user *models.User, messageID uint) (*models.Message, error) {
+	message, err := s.messageRepo.FindByID(messageID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Message not found")
+		}
+		return nil, err
+	}
+	if err := s.requireMember(user.ID, message.RoomID); err != nil {
+		return nil, err
+	}
+	if message.ParentID != nil {
+		return s.messageRepo.FindByID(*message.ParentID)
+	}
+	return message, nil
+}
+
+// findSent returns the message the user already sent with clientMsgID, or
+// nil if there is none.
+func (s *ChatService) findSent(userID uint, roomID uint, clientMsgID string) (*models.Message, error) {
+	message, err := s.messageRepo.FindByClientMsgID(userID, clientMsgID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if message.RoomID != roomID {
+		return nil, newChatError(ErrCodeInvalidPayload, "client_msg_id was already used in another room")
+	}
+	return message, nil
+}
+
+// findMessage loads a message that has not been deleted.
+func (s *ChatService) findMessage(messageID uint) (*models.Message, error) {
+	message, err := s.messageRepo.FindByID(messageID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Message not found")
+		}
+		return nil, err
+	}
+	if message.DeletedAt != nil {
+		return nil, newChatError(ErrCodeNotFound, "Message not found")
+	}
+	return message, nil
+}
+
+// requireAuthor fails unless the user may change the message: its
+// author, or with moderated set also a moderator or the owner of its
+// room. Messages of archived rooms cannot be changed, and muted authors
+// cannot edit theirs.
+func (s *ChatService) requireAuthor(user *models.User, message *models.Message, moderated bool) error {
+	room, member, err := s.memberRoom(user.ID, message.RoomID)
+	if err != nil {
+		return err
+	}
+	if room.IsArchived() {
+		return newChatError(ErrCodeForbidden, "This room is archived")
+	}
+	if message.UserID == user.ID {
+		if moderated {
+			return nil
+		}
+		return s.checkSanctions(user.ID, room.ID)
+	}
+	if moderated && !room.IsConversation() && member.HasRole(models.RoleModerator) {
+		return nil
+	}
+	return newChatError(ErrCodeForbidden, "Only the author can change this message")
+}
+
+// EditMessage replaces the body of a message and broadcasts
+// message_updated to its room. Users the edit newly mentions are
+// notified.
+func (s *ChatService) EditMessage(user *models.User, messageID uint, content string) (*models.Message, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, newChatError(ErrCodeInvalidPayload, "Message content is required")
+	}
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return nil, newChatError(ErrCodeInvalidPayload, "Message content is too long")
+	}
+
+	message, err := s.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAuthor(user, message, false); err != nil {
+		return nil, err
+	}
+	if content == message.Body {
+		return message, nil
+	}
+
+	if err := s.messageRepo.Edit(message, content, user.ID); err != nil {
+		return nil, err
+	}
+	if err := s.broadcastMessage(TypeMessageUpdated, message); err != nil {
+		return nil, err
+	}
+	return message, s.notifyMentions(message)
+}
+
+// DeleteMessage turns a message into a tombstone and broadcasts
+// message_deleted to its room. Moderators may delete any message of
+// their room; deleted_by tells who did.
+func (s *ChatService) DeleteMessage(user *models.User, messageID uint) (*models.Message, error) {
+	message, err := s.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAuthor(user, message, true); err != nil {
+		return nil, err
+	}
+
+	if err := s.messageRepo.Delete(message, user.ID); err != nil {
+		return nil, err
+	}
+	return message, s.broadcastMessage(TypeMessageDeleted, message)
+}
+
+// MessageEdits returns the edit history of a message to a room member.
+func (s *ChatService) MessageEdits(user *models.User, messageID uint) ([]models.MessageEdit, error) {
+	message, err := s.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireMember(user.ID, message.RoomID); err != nil {
+		return nil, err
+	}
+	return s.messageRepo.FindEdits(message.ID)
+}
+
+// broadcastMessage sends a frame about message to its room, or for thread
+// replies to the participants and viewers of the thread only.
+func (s *ChatService) broadcastMessage(frameType string, message *models.Message) error {
+	data, err := newEnvelope(frameType, "", message.RoomID, message)
+	if err != nil {
+		return err
+	}
+	return s.broadcastAbout(message, data)
+}
+
+// broadcastAbout sends a frame concerning message to whoever receives the
+// message itself.
+func (s *ChatService) broadcastAbout(message *models.Message, data []byte) error {
+	if message.ParentID == nil {
+		s.hub.BroadcastToRoom(message.RoomID, data)
+		return nil
+	}
+
+	participants, err := s.messageRepo.FindThreadParticipants(*message.ParentID)
+	if err != nil {
+		return err
+	}
+	s.hub.BroadcastToThread(message.RoomID, *message.ParentID, participants, data)
+	return nil
+}
+
+// JoinRoom adds the user to the room if they are not a member yet, before
+// a client subscribes to it. Direct message conversations cannot be
+// joined; their members are added by the DM endpoints. Private rooms are
+// entered by invitation only, restricted rooms through an approved join
+// request, and archived rooms take no new members.
+func (s *ChatService) JoinRoom(userID uint, roomID uint) error {
+	room, err := s.roomRepo.FindByID(roomID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return newChatError(ErrCodeNotFound, "Room not found")
+		}
+		return err
+	}
+
+	isMember, err := s.roomRepo.IsMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if isMember {
+		return nil
+	}
+	if room.IsConversation() {
+		return newChatError(ErrCodeForbidden, "Not a member of this conversation")
+	}
+	if room.IsPrivate() {
+		return newChatError(ErrCodeNotFound, "Room not found")
+	}
+	if !room.IsOpen() {
+		return newChatError(ErrCodeForbidden, "This room requires approval, send a join request instead")
+	}
+	if room.IsArchived() {
+		return newChatError(ErrCodeForbidden, "This room is archived")
+	}
+	return bannedError(s.roomRepo.AddUser(roomID, userID))
+}
+
+// Replay returns the frames a client that last saw lastSeq in room missed:
+// the chat_message frames of the top-level messages that followed, or a
+// single resync_required frame if there are more than limit. Thread
+// replies are not replayed, as they are not sent to the whole room;
+// clients fetch the threads whose reply count changed.
+func (s *ChatService) Replay(room *models.Room, lastSeq uint64, limit int) ([][]byte, error) {
+	if lastSeq >= room.LastSeq {
+		return nil, nil
+	}
+
+	if room.LastSeq-lastSeq > uint64(limit) {
+		data, err := newEnvelope(TypeResync, "", room.ID, ResyncPayload{LastSeq: room.LastSeq})
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+
+	messages, err := s.messageRepo.FindAfterSeq(room.ID, lastSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		data, err := newEnvelope(TypeChatMessage, "", room.ID, message)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, data)
+	}
+	return frames, nil
+}
+
+// MarkRead moves the user's read position in the room forward to
+// messageID and broadcasts a read receipt when it advanced.
+func (s *ChatService) MarkRead(user *models.User, roomID uint, messageID uint) (*models.ReadState, error) {
+	if err := s.requireMember(user.ID, roomID); err != nil {
+		return nil, err
+	}
+
+	message, err := s.messageRepo.FindByID(messageID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Message not found")
+		}
+		return nil, err
+	}
+	if message.RoomID != roomID {
+		return nil, newChatError(ErrCodeNotFound, "Message not found")
+	}
+
+	advanced, err := s.readRepo.MarkRead(user.ID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.readRepo.Find(user.ID, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if advanced {
+		data, err := newEnvelope(TypeReadReceipt, "", roomID, ReadReceiptPayload{
+			UserID:    user.ID,
+			MessageID: state.LastReadMessageID,
+			ReadAt:    state.UpdatedAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.hub.BroadcastToRoom(roomID, data)
+	}
+	return state, nil
+}
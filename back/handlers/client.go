@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"log"
+	"quickstart/models"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a single connection bound to the authenticated user it was
+// opened by; every frame it sends is attributed to that user. WebSocket
+// clients have a conn; SSE and long-poll clients have none and drain the
+// queue themselves.
+//
+// Outbound frames go through a bounded queue drained by writePump, so a
+// slow consumer never blocks the hub: when its queue is full the client
+// is disconnected instead.
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	user   *models.User
+	userID uint
+	// ephemeral clients (long-poll requests) receive room frames but do
+	// not count towards presence, which would flap between polls.
+	ephemeral bool
+	// roomScoped clients (SSE and long-poll requests) follow a single room
+	// and are closed once evicted from it, ending their request.
+	roomScoped bool
+
+	queueMu sync.Mutex
+	queue   chan []byte
+	closed  bool
+
+	// lastActive is the UnixNano time of the last frame received.
+	lastActive atomic.Int64
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, user *models.User, queueSize int) *Client {
+	client := &Client{
+		hub:    hub,
+		conn:   conn,
+		user:   user,
+		userID: user.ID,
+		queue:  make(chan []byte, queueSize),
+	}
+	client.touch()
+	return client
+}
+
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *Client) lastActiveAt() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// enqueue queues a frame for writePump. It reports false if the client is
+// closed, and closes it if its queue is full.
+func (c *Client) enqueue(data []byte) bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.queue <- data:
+		return true
+	default:
+		log.Printf("Send queue of user %d is full, disconnecting slow client", c.userID)
+		c.closed = true
+		close(c.queue)
+		return false
+	}
+}
+
+// close stops writePump, which then closes the connection.
+func (c *Client) close() {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+}
+
+// writePump writes queued frames and keepalive pings until the queue is
+// closed or a write fails. It owns all writes to the connection.
+func (c *Client) writePump(config WebSocketConfig) {
+	ticker := time.NewTicker(config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		// Unblocks the reader so the client gets unregistered.
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// roomMessage is a payload addressed to every client subscribed to a room,
+// except the connections of skipUserID when it is set. With threadID set
+// it is addressed to the viewers of that thread and to every connection
+// of userIDs instead; with only userIDs set, to those connections alone.
+//
+// With evict set, the connections of evictUserID, or all of them when it
+// is zero, are then unsubscribed from the room and its threads.
+type roomMessage struct {
+	roomID      uint
+	data        []byte
+	skipUserID  uint
+	threadID    uint
+	userIDs     []uint
+	evict       bool
+	evictUserID uint
+}
+
+// roomEvent is a roomMessage as published on the broker.
+type roomEvent struct {
+	RoomID      uint            `json:"room_id"`
+	SkipUserID  uint            `json:"skip_user_id,omitempty"`
+	ThreadID    uint            `json:"thread_id,omitempty"`
+	UserIDs     []uint          `json:"user_ids,omitempty"`
+	Evict       bool            `json:"evict,omitempty"`
+	EvictUserID uint            `json:"evict_user_id,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// subscription links a client to a room, or to a thread when threadID is
+// set. done is closed once the hub has applied the change.
+type subscription struct {
+	client   *Client
+	roomID   uint
+	threadID uint
+	done     chan struct{}
+}
+
+// Hub keeps track of the WebSocket clients of this instance, indexed by
+// user and by room, and fans out room messages. Broadcasts go through the
+// broker so that clients connected to other instances receive them too.
+// All mutations happen on the Run goroutine; the read lock lets handlers
+// query the current state.
+type Hub struct {
+	broker Broker
+	// nodeID identifies this instance on the broker.
+	nodeID string
+
+	mu      sync.RWMutex
+	clients map[*Client]bool
+	users   map[uint]map[*Client]bool
+	rooms   map[uint]map[*Client]bool
+	threads map[uint]map[*Client]bool
+	// threadRooms maps the threads in use to their room.
+	threadRooms map[uint]uint
+
+	register    chan *Client
+	unregister  chan *Client
+	subscribe   chan subscription
+	unsubscribe chan subscription
+	broadcast   chan roomMessage
+
+	// Presence state, see presence.go.
+	idleTimeout     time.Duration
+	presence        map[uint]string
+	lastSeen        map[uint]time.Time
+	nodes           map[uint]map[string]nodePresence
+	activity        chan uint
+	remotePresence  chan presenceEvent
+	presenceOut     chan presenceEvent
+	presenceChanges chan PresenceChange
+}
+
+// NewHub creates a hub on top of broker. Users whose connections have all
+// been idle for idleTimeout are reported as away.
+func NewHub(idleTimeout time.Duration, broker Broker) *Hub {
+	return &Hub{
+		broker:          broker,
+		nodeID:          newNodeID(),
+		clients:         make(map[*Client]bool),
+		users:           make(map[uint]map[*Client]bool),
+		rooms:           make(map[uint]map[*Client]bool),
+		threads:         make(map[uint]map[*Client]bool),
+		threadRooms:     make(map[uint]uint),
+		register:        make(chan *Client),
+		unregister:      make(chan *Client),
+		subscribe:       make(chan subscription),
+		unsubscribe:     make(chan subscription),
+		broadcast:       make(chan roomMessage, 256),
+		idleTimeout:     idleTimeout,
+		presence:        make(map[uint]string),
+		lastSeen:        make(map[uint]time.Time),
+		nodes:           make(map[uint]map[string]nodePresence),
+		activity:        make(chan uint, 256),
+		remotePresence:  make(chan presenceEvent, 256),
+		presenceOut:     make(chan presenceEvent, 1024),
+		presenceChanges: make(chan PresenceChange, 1024),
+	}
+}
+
+func newNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Failed to generate node ID:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Run processes hub events until the process exits.
+func (h *Hub) Run() {
+	ctx := context.Background()
+	messages, err := h.broker.Subscribe(ctx, brokerRoomChannel, brokerPresenceChannel)
+	if err != nil {
+		log.Fatal("Failed to subscribe to broker:", err)
+	}
+	go h.receive(messages)
+	go h.publishPresence(ctx)
+
+	idleTicker := time.NewTicker(presenceCheckInterval(h.idleTimeout))
+	defer idleTicker.Stop()
+
+	for {
+		select {
+		case client := <-h.register:
+			h.mu.Lock()
+			h.clients[client] = true
+			if !client.ephemeral {
+				if h.users[client.userID] == nil {
+					h.users[client.userID] = make(map[*Client]bool)
+				}
+				h.users[client.userID][client] = true
+				h.updatePresence(client.userID, time.Now())
+			}
+			h.mu.Unlock()
+
+		case client := <-h.unregister:
+			h.mu.Lock()
+			if h.clients[client] {
+				delete(h.clients, client)
+				removeClient(h.rooms, client)
+				for _, threadID := range removeClient(h.threads, client) {
+					delete(h.threadRooms, threadID)
+				}
+				if !client.ephemeral {
+					delete(h.users[client.userID], client)
+					if len(h.users[client.userID]) == 0 {
+						delete(h.users, client.userID)
+					}
+					h.updatePresence(client.userID, time.Now())
+				}
+			}
+			h.mu.Unlock()
+			client.close()
+
+		case sub := <-h.subscribe:
+			h.mu.Lock()
+			if h.clients[sub.client] {
+				index, key := h.subscriptionIndex(sub)
+				if index[key] == nil {
+					index[key] = make(map[*Client]bool)
+				}
+				index[key][sub.client] = true
+				if sub.threadID != 0 {
+					h.threadRooms[sub.threadID] = sub.roomID
+				}
+			}
+			h.mu.Unlock()
+			close(sub.done)
+
+		case sub := <-h.unsubscribe:
+			h.mu.Lock()
+			index, key := h.subscriptionIndex(sub)
+			if members, ok := index[key]; ok {
+				delete(members, sub.client)
+				if len(members) == 0 {
+					delete(index, key)
+					if sub.threadID != 0 {
+						delete(h.threadRooms, key)
+					}
+				}
+			}
+			h.mu.Unlock()
+			close(sub.done)
+
+		case msg := <-h.broadcast:
+			h.mu.RLock()
+			for client := range h.recipients(msg) {
+				if msg.skipUserID != 0 && client.userID == msg.skipUserID {
+					continue
+				}
+				client.enqueue(msg.data)
+			}
+			h.mu.RUnlock()
+			if msg.evict {
+				h.mu.Lock()
+				h.evict(msg.roomID, msg.evictUserID)
+				h.mu.Unlock()
+			}
+
+		case userID := <-h.activity:
+			h.mu.Lock()
+			h.updatePresence(userID, time.Now())
+			h.mu.Unlock()
+
+		case event := <-h.remotePresence:
+			h.mu.Lock()
+			h.applyRemotePresence(event, time.Now())
+			h.mu.Unlock()
+
+		case now := <-idleTicker.C:
+			h.mu.Lock()
+			for userID := range h.users {
+				h.updatePresence(userID, now)
+			}
+			h.refreshPresence(now)
+			h.mu.Unlock()
+		}
+	}
+}
+
+// subscriptionIndex returns the index a subscription applies to and its
+// key in it.
+func (h *Hub) subscriptionIndex(sub subscription) (map[uint]map[*Client]bool, uint) {
+	if sub.threadID != 0 {
+		return h.threads, sub.threadID
+	}
+	return h.rooms, sub.roomID
+}
+
+// recipients returns the local clients msg is addressed to. The caller
+// must hold h.mu.
+func (h *Hub) recipients(msg roomMessage) map[*Client]bool {
+	if msg.threadID == 0 && len(msg.userIDs) == 0 {
+		return h.rooms[msg.roomID]
+	}
+	clients := make(map[*Client]bool)
+	if msg.threadID != 0 {
+		for client := range h.threads[msg.threadID] {
+			clients[client] = true
+		}
+	}
+	for _, userID := range msg.userIDs {
+		for client := range h.users[userID] {
+			clients[client] = true
+		}
+	}
+	return clients
+}
+
+// removeClient drops a client from every entry of a subscription index
+// and returns the keys left without subscribers.
+func removeClient(index map[uint]map[*Client]bool, client *Client) []uint {
+	var emptied []uint
+	for key, members := range index {
+		delete(members, client)
+		if len(members) == 0 {
+			delete(index, key)
+			emptied = append(emptied, key)
+		}
+	}
+	return emptied
+}
+
+// evict unsubscribes the connections of userID, or every connection when
+// it is zero, from a room and its threads, and closes the room-scoped
+// ones. The caller must hold h.mu.
+func (h *Hub) evict(roomID uint, userID uint) {
+	drop := func(index map[uint]map[*Client]bool, key uint) bool {
+		for client := range index[key] {
+			if userID == 0 || client.userID == userID {
+				delete(index[key], client)
+				if client.roomScoped {
+					client.close()
+				}
+			}
+		}
+		if len(index[key]) == 0 {
+			delete(index, key)
+			return true
+		}
+		return false
+	}
+
+	drop(h.rooms, roomID)
+	for threadID, threadRoomID := range h.threadRooms {
+		if threadRoomID == roomID && drop(h.threads, threadID) {
+			delete(h.threadRooms, threadID)
+		}
+	}
+}
+
+// Join subscribes a client to a room's messages.
+func (h *Hub) Join(client *Client, roomID uint) {
+	done := make(chan struct{})
+	h.subscribe <- subscription{client: client, roomID: roomID, done: done}
+	<-done
+}
+
+// Leave removes a client's subscription to a room.
+func (h *Hub) Leave(client *Client, roomID uint) {
+	done := make(chan struct{})
+	h.unsubscribe <- subscription{client: client, roomID: roomID, done: done}
+	<-done
+}
+
+// receive feeds the messages of the broker into the hub.
+func (h *Hub) receive(messages <-chan BrokerMessage) {
+	for msg := range messages {
+		switch msg.Channel {
+		case brokerRoomChannel:
+			var event roomEvent
+			if err := json.Unmarshal(msg.Payload, &event); err != nil {
+				log.Println("Invalid room event from broker:", err)
+				continue
+			}
+			h.broadcast <- roomMessage{
+				roomID:      event.RoomID,
+				data:        event.Data,
+				skipUserID:  event.SkipUserID,
+				threadID:    event.ThreadID,
+				userIDs:     event.UserIDs,
+				evict:       event.Evict,
+				evictUserID: event.EvictUserID,
+			}
+
+		case brokerPresenceChannel:
+			var event presenceEvent
+			if err := json.Unmarshal(msg.Payload, &event); err != nil {
+				log.Println("Invalid presence event from broker:", err)
+				continue
+			}
+			h.remotePresence <- event
+		}
+	}
+	log.Println("Broker subscription closed")
+}
+
+// BroadcastToRoom sends data to every client subscribed to the room, on
+// every instance.
+func (h *Hub) BroadcastToRoom(roomID uint, data []byte) {
+	h.publishRoom(roomEvent{RoomID: roomID, Data: data})
+}
+
+// BroadcastToRoomExcept is BroadcastToRoom without the connections of
+// userID, for events about the user themselves.
+func (h *Hub) BroadcastToRoomExcept(roomID uint, data []byte, userID uint) {
+	h.publishRoom(roomEvent{RoomID: roomID, SkipUserID: userID, Data: data})
+}
+
+func (h *Hub) publishRoom(event roomEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to encode room event:", err)
+		return
+	}
+	if err := h.broker.Publish(context.Background(), brokerRoomChannel, payload); err != nil {
+		log.Printf("Failed to publish to room %d: %v", event.RoomID, err)
+	}
+}
+
+// broadcastLocal sends data to the clients of this instance only, for
+// events every instance derives on its own.
+func (h *Hub) broadcastLocal(roomID uint, data []byte) {
+	h.broadcast <- roomMessage{roomID: roomID, data: data}
+}
+
+// JoinThread subscribes a client to the live updates of a thread of a
+// room it is viewing.
+func (h *Hub) JoinThread(client *Client, roomID uint, threadID uint) {
+	done := make(chan struct{})
+	h.subscribe <- subscription{client: client, roomID: roomID, threadID: threadID, done: done}
+	<-done
+}
+
+// LeaveThread removes a client's subscription to a thread.
+func (h *Hub) LeaveThread(client *Client, threadID uint) {
+	done := make(chan struct{})
+	h.unsubscribe <- subscription{client: client, threadID: threadID, done: done}
+	<-done
+}
+
+// BroadcastToThread sends data to the viewers of a thread and to every
+// connection of participants, on every instance.
+func (h *Hub) BroadcastToThread(roomID uint, threadID uint, participants []uint, data []byte) {
+	h.publishRoom(roomEvent{RoomID: roomID, ThreadID: threadID, UserIDs: participants, Data: data})
+}
+
+// SendToUsers sends data to every connection of the users, on every
+// instance, whichever rooms they joined.
+func (h *Hub) SendToUsers(userIDs []uint, data []byte) {
+	h.publishRoom(roomEvent{UserIDs: userIDs, Data: data})
+}
+
+// RemoveFromRoom sends data to the room, then unsubscribes the
+// connections of userID from it and its threads, on every instance.
+func (h *Hub) RemoveFromRoom(roomID uint, userID uint, data []byte) {
+	h.publishRoom(roomEvent{RoomID: roomID, Data: data, Evict: true, EvictUserID: userID})
+}
+
+// CloseRoom sends data to the room, then unsubscribes every connection
+// from it and its threads, on every instance.
+func (h *Hub) CloseRoom(roomID uint, data []byte) {
+	h.publishRoom(roomEvent{RoomID: roomID, Data: data, Evict: true})
+}
+
+// IsSubscribed reports whether the client has joined the room.
+func (h *Hub) IsSubscribed(client *Client, roomID uint) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[roomID][client]
+}
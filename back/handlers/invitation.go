@@ -0,0 +1,599 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"quickstart/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// audit records an action in the room's audit log.
+func (s *ChatService) audit(roomID uint, actorID uint, action string, targetUserID *uint, detail string) error {
+	return s.auditRepo.Create(&models.AuditLog{
+		RoomID:       roomID,
+		ActorID:      actorID,
+		Action:       action,
+		TargetUserID: targetUserID,
+		Detail:       detail,
+	})
+}
+
+// generateInviteCode returns a random code short enough to share by hand.
+func generateInviteCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// invitableRoom loads a room the user may invite others to: any member of
+// a public room, and moderators of a restricted or private one.
+// Conversations grow through the DM endpoints instead, and archived rooms
+// take no members.
+func (s *ChatService) invitableRoom(user *models.User, roomID uint) (*models.Room, error) {
+	room, member, err := s.memberRoom(user.ID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.IsConversation() {
+		return nil, newChatError(ErrCodeForbidden, "Add participants to a conversation instead")
+	}
+	if room.IsArchived() {
+		return nil, newChatError(ErrCodeForbidden, "This room is archived")
+	}
+	if !room.IsOpen() && !member.HasRole(models.RoleModerator) {
+		return nil, newChatError(ErrCodeForbidden, "Only moderators can invite to this room")
+	}
+	return room, nil
+}
+
+// Invite invites a user to a room and sends them an invitation frame.
+// Inviting a user who already has a pending invitation returns it.
+func (s *ChatService) Invite(user *models.User, roomID uint, inviteeID uint) (*models.Invitation, error) {
+	room, err := s.invitableRoom(user, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if hasMember(room, inviteeID) {
+		return nil, newChatError(ErrCodeInvalidPayload, "User is already a member of this room")
+	}
+	ban, err := s.activeSanction(room.ID, inviteeID, models.SanctionBan)
+	if err != nil {
+		return nil, err
+	}
+	if ban != nil {
+		return nil, newChatError(ErrCodeForbidden, "User is banned from this room")
+	}
+
+	invitation, err := s.inviteRepo.FindPending(room.ID, inviteeID)
+	if err == nil {
+		return invitation, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	invitation = &models.Invitation{RoomID: room.ID, InviterID: user.ID, InviteeID: inviteeID, Status: models.InvitationPending}
+	if err := s.inviteRepo.Create(invitation); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "User not found")
+		}
+		return nil, err
+	}
+	if err := s.audit(room.ID, user.ID, models.AuditInvitationCreated, &inviteeID, fmt.Sprintf("invitation %d", invitation.ID)); err != nil {
+		return nil, err
+	}
+
+	invitation.Room = room
+	invitation.Inviter = user
+	data, err := newEnvelope(TypeInvitation, "", room.ID, invitation)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.SendToUsers([]uint{inviteeID}, data)
+	return invitation, nil
+}
+
+// Invitations returns the invitations the user has yet to answer.
+func (s *ChatService) Invitations(user *models.User) ([]models.Invitation, error) {
+	return s.inviteRepo.FindPendingByUser(user.ID)
+}
+
+// receivedInvitation loads an invitation addressed to the user. Other
+// users' invitations are reported as not found.
+func (s *ChatService) receivedInvitation(user *models.User, id uint) (*models.Invitation, error) {
+	invitation, err := s.inviteRepo.FindByID(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Invitation not found")
+		}
+		return nil, err
+	}
+	if invitation.InviteeID != user.ID {
+		return nil, newChatError(ErrCodeNotFound, "Invitation not found")
+	}
+	return invitation, nil
+}
+
+// closeError maps models.ErrInvitationClosed and models.ErrBanned to chat
+// errors.
+func closeError(err error) error {
+	if err == models.ErrInvitationClosed {
+		return newChatError(ErrCodeInvalidPayload, "Invitation is no longer pending")
+	}
+	return bannedError(err)
+}
+
+// AcceptInvitation makes the user a member of the room they were invited
+// to and returns the room.
+func (s *ChatService) AcceptInvitation(user *models.User, id uint) (*models.Room, error) {
+	invitation, err := s.receivedInvitation(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if invitation.Room.IsArchived() {
+		return nil, newChatError(ErrCodeForbidden, "This room is archived")
+	}
+
+	if err := s.inviteRepo.Accept(invitation); err != nil {
+		return nil, closeError(err)
+	}
+	if err := s.audit(invitation.RoomID, user.ID, models.AuditInvitationAccepted, &user.ID, fmt.Sprintf("invitation %d", invitation.ID)); err != nil {
+		return nil, err
+	}
+	return s.roomRepo.FindByID(invitation.RoomID)
+}
+
+// DeclineInvitation turns down an invitation to the user.
+func (s *ChatService) DeclineInvitation(user *models.User, id uint) error {
+	invitation, err := s.receivedInvitation(user, id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.inviteRepo.Close(invitation, models.InvitationDeclined); err != nil {
+		return closeError(err)
+	}
+	return s.audit(invitation.RoomID, user.ID, models.AuditInvitationDeclined, &user.ID, fmt.Sprintf("invitation %d", invitation.ID))
+}
+
+// RevokeInvitation withdraws a pending invitation. Its inviter and the
+// moderators of the room may.
+func (s *ChatService) RevokeInvitation(user *models.User, id uint) error {
+	invitation, err := s.inviteRepo.FindByID(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return newChatError(ErrCodeNotFound, "Invitation not found")
+		}
+		return err
+	}
+	if invitation.InviterID != user.ID {
+		member, err := s.roomRepo.FindMember(invitation.RoomID, user.ID)
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if err != nil || !member.HasRole(models.RoleModerator) {
+			return newChatError(ErrCodeNotFound, "Invitation not found")
+		}
+	}
+
+	if err := s.inviteRepo.Close(invitation, models.InvitationRevoked); err != nil {
+		return closeError(err)
+	}
+	return s.audit(invitation.RoomID, user.ID, models.AuditInvitationRevoked, &invitation.InviteeID, fmt.Sprintf("invitation %d", invitation.ID))
+}
+
+// CreateInviteLink creates a shareable invite link to a room. A maxUses
+// of 0 allows unlimited uses and a ttl of 0 never expires. Only the
+// room's moderators may.
+func (s *ChatService) CreateInviteLink(user *models.User, roomID uint, maxUses int, ttl time.Duration) (*models.InviteLink, error) {
+	if maxUses < 0 || ttl < 0 {
+		return nil, newChatError(ErrCodeInvalidPayload, "max_uses and expires_in must not be negative")
+	}
+	room, _, err := s.moderatedRoom(user, roomID, models.RoleModerator)
+	if err != nil {
+		return nil, err
+	}
+	if room.IsArchived() {
+		return nil, newChatError(ErrCodeForbidden, "This room is archived")
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		return nil, err
+	}
+	link := &models.InviteLink{RoomID: room.ID, Code: code, CreatorID: user.ID, MaxUses: maxUses}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		link.ExpiresAt = &expiresAt
+	}
+	if err := s.inviteRepo.CreateLink(link); err != nil {
+		return nil, err
+	}
+	return link, s.audit(room.ID, user.ID, models.AuditInviteLinkCreated, nil, fmt.Sprintf("invite link %d", link.ID))
+}
+
+// InviteLinks returns the invite links of a room to its moderators.
+func (s *ChatService) InviteLinks(user *models.User, roomID uint) ([]models.InviteLink, error) {
+	if _, _, err := s.moderatedRoom(user, roomID, models.RoleModerator); err != nil {
+		return nil, err
+	}
+	return s.inviteRepo.FindLinks(roomID)
+}
+
+// RevokeInviteLink stops an invite link from being redeemed. Only the
+// room's moderators may.
+func (s *ChatService) RevokeInviteLink(user *models.User, roomID uint, linkID uint) error {
+	if _, _, err := s.moderatedRoom(user, roomID, models.RoleModerator); err != nil {
+		return err
+	}
+	link, err := s.inviteRepo.FindLink(roomID, linkID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return newChatError(ErrCodeNotFound, "Invite link not found")
+		}
+		return err
+	}
+	if link.RevokedAt != nil {
+		return nil
+	}
+
+	if err := s.inviteRepo.RevokeLink(link); err != nil {
+		return err
+	}
+	return s.audit(roomID, user.ID, models.AuditInviteLinkRevoked, nil, fmt.Sprintf("invite link %d", link.ID))
+}
+
+// RedeemInviteLink makes the user a member of the room the code invites
+// to and returns the room. Members redeeming it again just get the room.
+func (s *ChatService) RedeemInviteLink(user *models.User, code string) (*models.Room, error) {
+	link, joined, err := s.inviteRepo.RedeemLink(code, user.ID)
+	if err != nil {
+		switch err {
+		case gorm.ErrRecordNotFound:
+			return nil, newChatError(ErrCodeNotFound, "Invite link not found")
+		case models.ErrInviteLinkInvalid:
+			return nil, newChatError(ErrCodeForbidden, "This invite link has expired or was revoked")
+		case models.ErrBanned:
+			return nil, bannedError(err)
+		}
+		return nil, err
+	}
+	if joined {
+		if err := s.audit(link.RoomID, user.ID, models.AuditInviteLinkUsed, &user.ID, fmt.Sprintf("invite link %d", link.ID)); err != nil {
+			return nil, err
+		}
+	}
+	return s.roomRepo.FindByID(link.RoomID)
+}
+
+// AuditLog returns a page of a room's audit log to its moderators.
+func (s *ChatService) AuditLog(user *models.User, roomID uint, query models.MessageQuery) ([]models.AuditLog, error) {
+	if _, _, err := s.moderatedRoom(user, roomID, models.RoleModerator); err != nil {
+		return nil, err
+	}
+	return s.auditRepo.FindByRoom(roomID, query)
+}
+
+type InviteRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+type CreateInviteLinkRequest struct {
+	// MaxUses caps how often the link can be redeemed; 0 is unlimited.
+	MaxUses int `json:"max_uses" binding:"min=0"`
+	// ExpiresIn is the lifetime of the link in seconds; 0 never expires.
+	ExpiresIn int `json:"expires_in" binding:"min=0"`
+}
+
+// AuditLogPage is a page of a room's audit log, newest first.
+type AuditLogPage struct {
+	Entries []models.AuditLog `json:"entries"`
+	HasMore bool              `json:"has_more"`
+}
+
+type InvitationHandler struct {
+	chat *ChatService
+}
+
+func NewInvitationHandler(chat *ChatService) *InvitationHandler {
+	return &InvitationHandler{chat: chat}
+}
+
+// InviteUser godoc
+// @Summary Invite a user to a room
+// @Schemes
+// @Description Invite a user to a room. The invitee gets an invitation frame and joins once they accept. Any member can invite to a public room; restricted and private rooms take a moderator. Inviting a user again returns their pending invitation.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param invitation body InviteRequest true "Invitee"
+// @Success 201 {object} models.Invitation
+// @Router /rooms/{roomId}/invitations [post]
+func (h *InvitationHandler) InviteUser(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req InviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invitation, err := h.chat.Invite(currentUser(c), uint(roomID), req.UserID)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, invitation)
+}
+
+// GetMyInvitations godoc
+// @Summary Get my invitations
+// @Schemes
+// @Description Get the room invitations the current user has yet to accept or decline, newest first
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.Invitation
+// @Router /me/invitations [get]
+func (h *InvitationHandler) GetMyInvitations(c *gin.Context) {
+	invitations, err := h.chat.Invitations(currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// AcceptInvitation godoc
+// @Summary Accept an invitation
+// @Schemes
+// @Description Accept an invitation to the current user and join its room
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Invitation ID"
+// @Success 200 {object} models.Room
+// @Router /invitations/{id}/accept [post]
+func (h *InvitationHandler) AcceptInvitation(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	room, err := h.chat.AcceptInvitation(currentUser(c), uint(id))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, room)
+}
+
+// DeclineInvitation godoc
+// @Summary Decline an invitation
+// @Schemes
+// @Description Decline an invitation to the current user
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Invitation ID"
+// @Success 204
+// @Router /invitations/{id}/decline [post]
+func (h *InvitationHandler) DeclineInvitation(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	if err := h.chat.DeclineInvitation(currentUser(c), uint(id)); err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeInvitation godoc
+// @Summary Revoke an invitation
+// @Schemes
+// @Description Withdraw a pending invitation. Its inviter and the moderators of its room can revoke it.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Invitation ID"
+// @Success 204
+// @Router /invitations/{id} [delete]
+func (h *InvitationHandler) RevokeInvitation(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	if err := h.chat.RevokeInvitation(currentUser(c), uint(id)); err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// CreateInviteLink godoc
+// @Summary Create an invite link
+// @Schemes
+// @Description Create a shareable invite code for a room, optionally limited in uses and lifetime. Only moderators can create invite links.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param link body CreateInviteLinkRequest true "Limits"
+// @Success 201 {object} models.InviteLink
+// @Router /rooms/{roomId}/invite-links [post]
+func (h *InvitationHandler) CreateInviteLink(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req CreateInviteLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	link, err := h.chat.CreateInviteLink(currentUser(c), uint(roomID), req.MaxUses, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, link)
+}
+
+// GetInviteLinks godoc
+// @Summary Get the invite links of a room
+// @Schemes
+// @Description Get the invite links of a room, newest first, including revoked and used up ones. Only moderators can list invite links.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 200 {array} models.InviteLink
+// @Router /rooms/{id}/invite-links [get]
+func (h *InvitationHandler) GetInviteLinks(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	links, err := h.chat.InviteLinks(currentUser(c), uint(roomID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+// RevokeInviteLink godoc
+// @Summary Revoke an invite link
+// @Schemes
+// @Description Stop an invite link from being redeemed. Members who joined through it stay. Only moderators can revoke invite links.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param linkId path int true "Invite link ID"
+// @Success 204
+// @Router /rooms/{id}/invite-links/{linkId} [delete]
+func (h *InvitationHandler) RevokeInviteLink(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	linkID, err := strconv.ParseUint(c.Param("linkId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite link ID"})
+		return
+	}
+
+	if err := h.chat.RevokeInviteLink(currentUser(c), uint(roomID), uint(linkID)); err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RedeemInviteLink godoc
+// @Summary Join a room with an invite code
+// @Schemes
+// @Description Join the room an invite code was created for, whatever its visibility. Redeeming a code for a room the current user is already in does not use it up.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param code path string true "Invite code"
+// @Success 200 {object} models.Room
+// @Router /invite-links/{code}/join [post]
+func (h *InvitationHandler) RedeemInviteLink(c *gin.Context) {
+	room, err := h.chat.RedeemInviteLink(currentUser(c), c.Param("code"))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, room)
+}
+
+// GetAuditLog godoc
+// @Summary Get the audit log of a room
+// @Schemes
+// @Description Get a page of the audit log of a room, newest first: invitations and invite links created, answered, revoked and used. Use before with the ID of the last entry to load older ones. Only moderators can read the audit log.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param before query int false "Only entries with an ID lower than this"
+// @Param limit query int false "Page size (default 50, max 100)"
+// @Success 200 {object} AuditLogPage
+// @Router /rooms/{id}/audit-log [get]
+func (h *InvitationHandler) GetAuditLog(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if query.After != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The audit log is only paginated with before"})
+		return
+	}
+
+	limit := query.Limit
+	query.Limit++
+	entries, err := h.chat.AuditLog(currentUser(c), uint(roomID), query)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	page := AuditLogPage{Entries: entries, HasMore: len(entries) > limit}
+	if page.HasMore {
+		page.Entries = entries[:limit]
+	}
+	c.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"quickstart/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RequestToJoin asks the moderators of a restricted room to let the user
+// in and sends them a join_request frame. The request expires after ttl.
+// Asking again while a request is pending returns it. Banned users
+// cannot ask.
+func (s *ChatService) RequestToJoin(user *models.User, roomID uint, note string, ttl time.Duration) (*models.JoinRequest, error) {
+	room, err := s.roomRepo.FindByID(roomID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Room not found")
+		}
+		return nil, err
+	}
+	if room.IsPrivate() {
+		return nil, newChatError(ErrCodeNotFound, "Room not found")
+	}
+	if hasMember(room, user.ID) {
+		return nil, newChatError(ErrCodeInvalidPayload, "Already a member of this room")
+	}
+	if room.IsOpen() {
+		return nil, newChatError(ErrCodeInvalidPayload, "This room can be joined directly")
+	}
+	if room.IsArchived() {
+		return nil, newChatError(ErrCodeForbidden, "This room is archived")
+	}
+	ban, err := s.activeSanction(room.ID, user.ID, models.SanctionBan)
+	if err != nil {
+		return nil, err
+	}
+	if ban != nil {
+		return nil, newChatError(ErrCodeForbidden, "Banned from this room")
+	}
+
+	request, err := s.joinRepo.FindPending(room.ID, user.ID)
+	if err == nil {
+		return request, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	request = &models.JoinRequest{
+		RoomID:    room.ID,
+		UserID:    user.ID,
+		Note:      strings.TrimSpace(note),
+		Status:    models.JoinRequestPending,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.joinRepo.Create(request); err != nil {
+		return nil, err
+	}
+	request.User = user
+
+	members, err := s.roomRepo.FindMembers(room.ID)
+	if err != nil {
+		return nil, err
+	}
+	var moderatorIDs []uint
+	for _, member := range members {
+		if member.HasRole(models.RoleModerator) {
+			moderatorIDs = append(moderatorIDs, member.UserID)
+		}
+	}
+	data, err := newEnvelope(TypeJoinRequest, "", room.ID, request)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.SendToUsers(moderatorIDs, data)
+	return request, nil
+}
+
+// JoinRequests returns the pending join requests of a room to its
+// moderators, oldest first.
+func (s *ChatService) JoinRequests(user *models.User, roomID uint) ([]models.JoinRequest, error) {
+	if _, _, err := s.moderatedRoom(user, roomID, models.RoleModerator); err != nil {
+		return nil, err
+	}
+	return s.joinRepo.FindPendingByRoom(roomID)
+}
+
+// ReviewJoinRequest approves or rejects a pending join request, audits it
+// and tells the requester with join_request_updated. Approving makes them
+// a member. Only the room's moderators may.
+func (s *ChatService) ReviewJoinRequest(user *models.User, roomID uint, requestID uint, approve bool) (*models.JoinRequest, error) {
+	room, _, err := s.moderatedRoom(user, roomID, models.RoleModerator)
+	if err != nil {
+		return nil, err
+	}
+	if approve && room.IsArchived() {
+		return nil, newChatError(ErrCodeForbidden, "This room is archived")
+	}
+	request, err := s.joinRepo.FindByID(roomID, requestID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Join request not found")
+		}
+		return nil, err
+	}
+
+	action := models.AuditJoinRequestRejected
+	review := s.joinRepo.Reject
+	if approve {
+		action = models.AuditJoinRequestApproved
+		review = s.joinRepo.Approve
+	}
+	if err := review(request, user.ID); err != nil {
+		switch err {
+		case models.ErrJoinRequestClosed:
+			return nil, newChatError(ErrCodeInvalidPayload, "Join request is no longer pending")
+		case models.ErrBanned:
+			return nil, newChatError(ErrCodeForbidden, "User is banned from this room")
+		}
+		return nil, err
+	}
+	if err := s.audit(roomID, user.ID, action, &request.UserID, fmt.Sprintf("join request %d", request.ID)); err != nil {
+		return nil, err
+	}
+	return request, s.notifyRequester(request)
+}
+
+// ExpireJoinRequests marks stale join requests expired every interval and
+// tells their requesters. It never returns.
+func (s *ChatService) ExpireJoinRequests(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		requests, err := s.joinRepo.Expire(now)
+		if err != nil {
+			log.Println("Failed to expire join requests:", err)
+			continue
+		}
+		for i := range requests {
+			if err := s.notifyRequester(&requests[i]); err != nil {
+				log.Println("Failed to notify expired join request:", err)
+			}
+		}
+	}
+}
+
+func (s *ChatService) notifyRequester(request *models.JoinRequest) error {
+	data, err := newEnvelope(TypeJoinRequestUpdated, "", request.RoomID, request)
+	if err != nil {
+		return err
+	}
+	s.hub.SendToUsers([]uint{request.UserID}, data)
+	return nil
+}
+
+type JoinRequestRequest struct {
+	Note string `json:"note" binding:"max=500"`
+}
+
+type JoinRequestHandler struct {
+	chat *ChatService
+	ttl  time.Duration
+}
+
+// NewJoinRequestHandler creates join requests that expire after ttl.
+func NewJoinRequestHandler(chat *ChatService, ttl time.Duration) *JoinRequestHandler {
+	return &JoinRequestHandler{chat: chat, ttl: ttl}
+}
+
+// RequestToJoin godoc
+// @Summary Ask to join a room
+// @Schemes
+// @Description Ask to join a restricted room, with an optional note to its moderators, who get a join_request frame. The request expires if nobody reviews it in time. Asking again while a request is pending returns it. Users banned from the room cannot ask.
+// @Tags join-requests
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param request body JoinRequestRequest false "Note to the moderators"
+// @Success 201 {object} models.JoinRequest
+// @Router /rooms/{roomId}/join-requests [post]
+func (h *JoinRequestHandler) RequestToJoin(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req JoinRequestRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	request, err := h.chat.RequestToJoin(currentUser(c), uint(roomID), req.Note, h.ttl)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+// GetJoinRequests godoc
+// @Summary Get the join requests of a room
+// @Schemes
+// @Description Get the pending join requests of a room, oldest first. Only moderators can list join requests.
+// @Tags join-requests
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 200 {array} models.JoinRequest
+// @Router /rooms/{id}/join-requests [get]
+func (h *JoinRequestHandler) GetJoinRequests(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	requests, err := h.chat.JoinRequests(currentUser(c), uint(roomID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// ApproveJoinRequest godoc
+// @Summary Approve a join request
+// @Schemes
+// @Description Let the requester into the room. They get a join_request_updated frame. Only moderators can approve join requests.
+// @Tags join-requests
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param requestId path int true "Join request ID"
+// @Success 200 {object} models.JoinRequest
+// @Router /rooms/{roomId}/join-requests/{requestId}/approve [post]
+func (h *JoinRequestHandler) ApproveJoinRequest(c *gin.Context) {
+	h.review(c, true)
+}
+
+// RejectJoinRequest godoc
+// @Summary Reject a join request
+// @Schemes
+// @Description Turn down a join request. The requester gets a join_request_updated frame. Only moderators can reject join requests.
+// @Tags join-requests
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param requestId path int true "Join request ID"
+// @Success 200 {object} models.JoinRequest
+// @Router /rooms/{roomId}/join-requests/{requestId}/reject [post]
+func (h *JoinRequestHandler) RejectJoinRequest(c *gin.Context) {
+	h.review(c, false)
+}
+
+func (h *JoinRequestHandler) review(c *gin.Context, approve bool) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	requestID, err := strconv.ParseUint(c.Param("requestId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid join request ID"})
+		return
+	}
+
+	request, err := h.chat.ReviewJoinRequest(currentUser(c), uint(roomID), uint(requestID), approve)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
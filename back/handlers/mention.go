@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"quickstart/models"
+	"regexp"
+	"strings"
+)
+
+// mentionPattern matches @name where the @ does not follow a word, so
+// e-mail addresses are not mistaken for mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@.])@([\p{L}\p{N}_][\p{L}\p{N}_.-]*)`)
+
+// mentionRank orders the mention kinds; a user mentioned by name and by
+// @room is notified once, as mentioned by name.
+var mentionRank = map[string]int{models.MentionKindRoom: 0, models.MentionKindHere: 1, models.MentionKindUser: 2}
+
+// MentionPayload notifies a user that Message mentioned them. It is sent
+// to all of their connections, whether or not they joined the room.
+type MentionPayload struct {
+	Kind    string          `json:"kind"`
+	Message *models.Message `json:"message"`
+}
+
+// parseMentions returns the names mentioned in body, lowercased. @room
+// and @here come out as "room" and "here".
+func parseMentions(body string) []string {
+	var names []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// Punctuation ending a sentence is not part of the name.
+		name := strings.TrimRight(match[1], ".-")
+		names = append(names, strings.ToLower(name))
+	}
+	return names
+}
+
+// notifyMentions resolves the mentions in a message against the members
+// of its room, records them and sends a mention event to each newly
+// mentioned user. The author is never notified of their own mentions.
+func (s *ChatService) notifyMentions(message *models.Message) error {
+	names := parseMentions(message.Body)
+	if len(names) == 0 {
+		return nil
+	}
+	room, err := s.roomRepo.FindByID(message.RoomID)
+	if err != nil {
+		return err
+	}
+
+	kinds := make(map[uint]string)
+	mention := func(userID uint, kind string) {
+		if current, ok := kinds[userID]; !ok || mentionRank[kind] > mentionRank[current] {
+			kinds[userID] = kind
+		}
+	}
+	for _, name := range names {
+		for _, user := range room.Users {
+			switch {
+			case name == models.MentionKindRoom:
+				mention(user.ID, models.MentionKindRoom)
+			case name == models.MentionKindHere:
+				if s.hub.Presence(user.ID).Status == PresenceOnline {
+					mention(user.ID, models.MentionKindHere)
+				}
+			case strings.EqualFold(user.Name, name):
+				mention(user.ID, models.MentionKindUser)
+			}
+		}
+	}
+	delete(kinds, message.UserID)
+
+	byKind := make(map[string][]uint)
+	for userID, kind := range kinds {
+		created, err := s.mentionRepo.Create(&models.Mention{
+			MessageID: message.ID,
+			UserID:    userID,
+			RoomID:    message.RoomID,
+			Kind:      kind,
+		})
+		if err != nil {
+			return err
+		}
+		if created {
+			byKind[kind] = append(byKind[kind], userID)
+		}
+	}
+
+	for kind, userIDs := range byKind {
+		data, err := newEnvelope(TypeMention, "", message.RoomID, MentionPayload{Kind: kind, Message: message})
+		if err != nil {
+			return err
+		}
+		s.hub.SendToUsers(userIDs, data)
+	}
+	return nil
+}
+
+// Mentions returns a page of the messages that mentioned the user, newest
+// first.
+func (s *ChatService) Mentions(user *models.User, query models.MessageQuery) ([]models.Mention, error) {
+	return s.mentionRepo.FindByUser(user.ID, query)
+}
@@ -0,0 +1,488 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"quickstart/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+type MessageHandler struct {
+	messageRepo models.MessageRepository
+	roomRepo    models.RoomRepository
+	chat        *ChatService
+}
+
+type SendMessageRequest struct {
+	Content     string `json:"content" binding:"required"`
+	ClientMsgID string `json:"client_msg_id"`
+	ParentID    uint   `json:"parent_id"`
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+type AddReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required"`
+}
+
+type MarkReadRequest struct {
+	MessageID uint `json:"message_id" binding:"required"`
+}
+
+// MentionPage is a page of the current user's mentions, newest first.
+type MentionPage struct {
+	Mentions []models.Mention `json:"mentions"`
+	HasMore  bool             `json:"has_more"`
+}
+
+// MessagePage is a page of room history in chronological order.
+type MessagePage struct {
+	Messages []models.Message `json:"messages"`
+	HasMore  bool             `json:"has_more"`
+}
+
+func NewMessageHandler(messageRepo models.MessageRepository, roomRepo models.RoomRepository, chat *ChatService) *MessageHandler {
+	return &MessageHandler{messageRepo: messageRepo, roomRepo: roomRepo, chat: chat}
+}
+
+// GetRoomMessages godoc
+// @Summary Get room messages
+// @Schemes
+// @Description Get a page of a room's message history, without thread replies. Each message carries its reactions, with me set on those of the current user. Direct message history is only visible to its two members. Without cursors the newest messages are returned; use before to load older scrollback and after to catch up on newer messages.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param before query int false "Only messages with an ID lower than this"
+// @Param after query int false "Only messages with an ID higher than this"
+// @Param limit query int false "Page size (default 50, max 100)"
+// @Success 200 {object} MessagePage
+// @Router /rooms/{id}/messages [get]
+func (h *MessageHandler) GetRoomMessages(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room, err := h.roomRepo.FindByID(uint(roomID))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !room.IsOpen() {
+		isMember, err := h.roomRepo.IsMember(room.ID, currentUser(c).ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !isMember && room.IsPrivate() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+			return
+		}
+		if !isMember {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+			return
+		}
+	}
+
+	page, err := fetchMessagePage(query, func(query models.MessageQuery) ([]models.Message, error) {
+		return h.messageRepo.FindByRoom(uint(roomID), query)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.chat.LoadReactions(currentUser(c).ID, page.Messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// GetMessageReplies godoc
+// @Summary Get thread replies
+// @Schemes
+// @Description Get a page of the replies in the thread of a message, paginated like room messages. The thread root itself carries reply_count and last_reply_at.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Message ID"
+// @Param before query int false "Only replies with an ID lower than this"
+// @Param after query int false "Only replies with an ID higher than this"
+// @Param limit query int false "Page size (default 50, max 100)"
+// @Success 200 {object} MessagePage
+// @Router /messages/{id}/replies [get]
+func (h *MessageHandler) GetMessageReplies(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	root, err := h.chat.OpenThread(currentUser(c), uint(messageID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	page, err := fetchMessagePage(query, func(query models.MessageQuery) ([]models.Message, error) {
+		return h.messageRepo.FindReplies(root.ID, query)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.chat.LoadReactions(currentUser(c).ID, page.Messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// fetchMessagePage runs find for query, fetching one extra row to know
+// whether another page exists.
+func fetchMessagePage(query models.MessageQuery, find func(models.MessageQuery) ([]models.Message, error)) (MessagePage, error) {
+	limit := query.Limit
+	query.Limit++
+	messages, err := find(query)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	page := MessagePage{Messages: messages, HasMore: len(messages) > limit}
+	if page.HasMore {
+		if query.After != 0 {
+			page.Messages = messages[:limit]
+		} else {
+			page.Messages = messages[1:]
+		}
+	}
+	return page, nil
+}
+
+// SendRoomMessage godoc
+// @Summary Send a message
+// @Schemes
+// @Description Post a message to a room and broadcast it to the room, as a chat_message frame over /ws does. For clients that cannot keep a WebSocket open. Retrying with the same client_msg_id returns the stored message instead of creating another. With parent_id the message is a reply in that message's thread.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param message body SendMessageRequest true "Message"
+// @Success 201 {object} models.Message
+// @Router /rooms/{roomId}/messages [post]
+func (h *MessageHandler) SendRoomMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := h.chat.SendMessage(currentUser(c), uint(roomID), ChatMessagePayload{
+		Content:     req.Content,
+		ClientMsgID: req.ClientMsgID,
+		ParentID:    req.ParentID,
+	})
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, message)
+}
+
+// EditMessage godoc
+// @Summary Edit a message
+// @Schemes
+// @Description Replace the content of a message and broadcast message_updated to its room. Only the author can edit a message; moderators can delete other members' messages but not edit them. The previous content is kept in its edit history.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Message ID"
+// @Param message body EditMessageRequest true "New content"
+// @Success 200 {object} models.Message
+// @Router /messages/{id} [patch]
+func (h *MessageHandler) EditMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := h.chat.EditMessage(currentUser(c), uint(messageID), req.Content)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, message)
+}
+
+// DeleteMessage godoc
+// @Summary Delete a message
+// @Schemes
+// @Description Delete a message and broadcast message_deleted to its room. The author can delete their message, and in rooms (not conversations) so can its moderators and owner. The message stays in the history as a tombstone with an empty body and deleted_at set.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Message ID"
+// @Success 200 {object} models.Message
+// @Router /messages/{id} [delete]
+func (h *MessageHandler) DeleteMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	message, err := h.chat.DeleteMessage(currentUser(c), uint(messageID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, message)
+}
+
+// GetMessageEdits godoc
+// @Summary Get message edit history
+// @Schemes
+// @Description Get the previous versions of a message, oldest first. Not available for deleted messages.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Message ID"
+// @Success 200 {array} models.MessageEdit
+// @Router /messages/{id}/edits [get]
+func (h *MessageHandler) GetMessageEdits(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	edits, err := h.chat.MessageEdits(currentUser(c), uint(messageID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, edits)
+}
+
+// AddReaction godoc
+// @Summary React to a message
+// @Schemes
+// @Description Add the current user's reaction to a message and broadcast reaction_added to whoever receives the message. The emoji is a unicode emoji or a custom :shortcode:. Reacting twice with the same emoji changes nothing; a message has at most 20 different emoji. Returns the message's reactions.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Message ID"
+// @Param reaction body AddReactionRequest true "Reaction"
+// @Success 200 {array} models.ReactionSummary
+// @Router /messages/{id}/reactions [post]
+func (h *MessageHandler) AddReaction(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var req AddReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reactions, err := h.chat.AddReaction(currentUser(c), uint(messageID), req.Emoji)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, reactions)
+}
+
+// RemoveReaction godoc
+// @Summary Remove a reaction
+// @Schemes
+// @Description Remove the current user's reaction with an emoji from a message and broadcast reaction_removed. The emoji must be URL-encoded. Returns the message's reactions.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Message ID"
+// @Param emoji path string true "Emoji or :shortcode:"
+// @Success 200 {array} models.ReactionSummary
+// @Router /messages/{id}/reactions/{emoji} [delete]
+func (h *MessageHandler) RemoveReaction(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	reactions, err := h.chat.RemoveReaction(currentUser(c), uint(messageID), c.Param("emoji"))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, reactions)
+}
+
+// MarkRoomRead godoc
+// @Summary Mark room as read
+// @Schemes
+// @Description Mark every message up to message_id as read for the current user and broadcast a read receipt to the room. The read position never moves backwards.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param read body MarkReadRequest true "Last read message"
+// @Success 200 {object} models.ReadState
+// @Router /rooms/{roomId}/read [post]
+func (h *MessageHandler) MarkRoomRead(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req MarkReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	state, err := h.chat.MarkRead(currentUser(c), uint(roomID), req.MessageID)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// GetMyMentions godoc
+// @Summary Get my mentions
+// @Schemes
+// @Description Get a page of the messages that mentioned the current user by name, @room or @here, newest first. Use before with the ID of the last mention to load older ones. Mentions by deleted messages, and in rooms the user has left or was removed from, are left out.
+// @Tags messages
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param before query int false "Only mentions with an ID lower than this"
+// @Param limit query int false "Page size (default 50, max 100)"
+// @Success 200 {object} MentionPage
+// @Router /me/mentions [get]
+func (h *MessageHandler) GetMyMentions(c *gin.Context) {
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if query.After != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mentions are only paginated with before"})
+		return
+	}
+
+	limit := query.Limit
+	query.Limit++
+	mentions, err := h.chat.Mentions(currentUser(c), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	page := MentionPage{Mentions: mentions, HasMore: len(mentions) > limit}
+	if page.HasMore {
+		page.Mentions = mentions[:limit]
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// parseMessageQuery reads the before/after/limit pagination parameters.
+func parseMessageQuery(c *gin.Context) (models.MessageQuery, error) {
+	query := models.MessageQuery{Limit: defaultMessagePageSize}
+
+	if s := c.Query("before"); s != "" {
+		before, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return query, errors.New("Invalid before cursor")
+		}
+		query.Before = uint(before)
+	}
+	if s := c.Query("after"); s != "" {
+		after, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return query, errors.New("Invalid after cursor")
+		}
+		query.After = uint(after)
+	}
+	if query.Before != 0 && query.After != 0 {
+		return query, errors.New("Cannot combine before and after cursors")
+	}
+
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return query, errors.New("Invalid limit")
+		}
+		if limit > maxMessagePageSize {
+			limit = maxMessagePageSize
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"quickstart/models"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const currentUserKey = "currentUser"
+
+// AuthMiddleware rejects requests without a valid Bearer access token and
+// stores the authenticated user in the context.
+func AuthMiddleware(tokens *TokenManager, userRepo models.UserRepository) gin.HandlerFunc {
+	return authMiddleware(tokens, userRepo, false)
+}
+
+// StreamAuthMiddleware is AuthMiddleware that also accepts the access
+// token as the token query parameter, since EventSource cannot set headers.
+func StreamAuthMiddleware(tokens *TokenManager, userRepo models.UserRepository) gin.HandlerFunc {
+	return authMiddleware(tokens, userRepo, true)
+}
+
+func authMiddleware(tokens *TokenManager, userRepo models.UserRepository, allowQuery bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			tokenString = ""
+			if allowQuery {
+				tokenString = c.Query("token")
+			}
+		}
+		if tokenString == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing access token"})
+			return
+		}
+
+		userID, err := tokens.ParseAccessToken(tokenString)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
+			return
+		}
+
+		user, err := userRepo.FindByID(userID)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(currentUserKey, user)
+		c.Next()
+	}
+}
+
+// currentUser returns the user stored by AuthMiddleware.
+func currentUser(c *gin.Context) *models.User {
+	return c.MustGet(currentUserKey).(*models.User)
+}
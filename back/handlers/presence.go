@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"quickstart/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Presence statuses. A user is online while at least one of their
+// connections has been active within the idle timeout, away while all of
+// them are idle and offline once the last one disconnects.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// PresenceChange is emitted by the hub whenever a user's status changes.
+type PresenceChange struct {
+	UserID   uint
+	Status   string
+	LastSeen time.Time
+}
+
+// PresencePayload describes a user's status, in presence frames and in
+// the REST presence listing.
+type PresencePayload struct {
+	UserID   uint       `json:"user_id"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// presenceCheckInterval is how often the hub looks for idle users and
+// refreshes the presence it published on the broker.
+func presenceCheckInterval(idleTimeout time.Duration) time.Duration {
+	if interval := idleTimeout / 4; interval > time.Second {
+		return interval
+	}
+	return time.Second
+}
+
+// presenceRank orders statuses when merging instances: a user is online if
+// any instance sees them online.
+var presenceRank = map[string]int{PresenceOffline: 0, PresenceAway: 1, PresenceOnline: 2}
+
+// nodePresence is the status of a user on one instance. refreshed is when
+// it was last published, so entries of a crashed instance expire.
+type nodePresence struct {
+	status    string
+	lastSeen  time.Time
+	refreshed time.Time
+}
+
+// presenceEvent carries the status of a user on one instance over the
+// broker. Instances publish it on every change and on every presence check
+// for the users they hold.
+type presenceEvent struct {
+	Node     string    `json:"node"`
+	UserID   uint      `json:"user_id"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// updatePresence recomputes the status of a user from the connections of
+// this instance, publishes it if it changed and merges it with the other
+// instances. The caller must hold h.mu.
+func (h *Hub) updatePresence(userID uint, now time.Time) {
+	status, lastSeen := PresenceOffline, now
+	if clients := h.users[userID]; len(clients) > 0 {
+		var lastActive time.Time
+		for client := range clients {
+			if t := client.lastActiveAt(); t.After(lastActive) {
+				lastActive = t
+			}
+		}
+		status = PresenceAway
+		if now.Sub(lastActive) < h.idleTimeout {
+			status = PresenceOnline
+		}
+		lastSeen = lastActive
+	}
+
+	previous := PresenceOffline
+	if p, ok := h.nodes[userID][h.nodeID]; ok {
+		previous = p.status
+	}
+	if status == previous && status == PresenceOffline {
+		return
+	}
+	h.setNodePresence(userID, h.nodeID, status, lastSeen, now)
+	if status != previous {
+		h.queuePresenceEvent(presenceEvent{Node: h.nodeID, UserID: userID, Status: status, LastSeen: lastSeen})
+	}
+	h.mergePresence(userID)
+}
+
+// applyRemotePresence records the status of a user on another instance.
+// The caller must hold h.mu.
+func (h *Hub) applyRemotePresence(event presenceEvent, now time.Time) {
+	if event.Node == h.nodeID {
+		return
+	}
+	if _, ok := presenceRank[event.Status]; !ok {
+		return
+	}
+	h.setNodePresence(event.UserID, event.Node, event.Status, event.LastSeen, now)
+	h.mergePresence(event.UserID)
+}
+
+// refreshPresence republishes the users held by this instance and expires
+// the entries of instances that stopped refreshing theirs. The caller must
+// hold h.mu.
+func (h *Hub) refreshPresence(now time.Time) {
+	for userID, nodes := range h.nodes {
+		for node, p := range nodes {
+			if node == h.nodeID {
+				h.queuePresenceEvent(presenceEvent{Node: node, UserID: userID, Status: p.status, LastSeen: p.lastSeen})
+				continue
+			}
+			if now.Sub(p.refreshed) > 3*presenceCheckInterval(h.idleTimeout) {
+				h.setNodePresence(userID, node, PresenceOffline, p.lastSeen, now)
+				h.mergePresence(userID)
+			}
+		}
+	}
+}
+
+// setNodePresence stores the status of a user on one instance. The caller
+// must hold h.mu.
+func (h *Hub) setNodePresence(userID uint, node string, status string, lastSeen time.Time, now time.Time) {
+	if status == PresenceOffline {
+		delete(h.nodes[userID], node)
+		if len(h.nodes[userID]) == 0 {
+			delete(h.nodes, userID)
+		}
+	} else {
+		if h.nodes[userID] == nil {
+			h.nodes[userID] = make(map[string]nodePresence)
+		}
+		h.nodes[userID][node] = nodePresence{status: status, lastSeen: lastSeen, refreshed: now}
+	}
+	if lastSeen.After(h.lastSeen[userID]) {
+		h.lastSeen[userID] = lastSeen
+	}
+}
+
+// mergePresence derives the status of a user from every instance and
+// queues a PresenceChange if it changed. Every instance sees the same
+// changes, so each one reports them to its own clients only. The caller
+// must hold h.mu.
+func (h *Hub) mergePresence(userID uint) {
+	status := PresenceOffline
+	for _, p := range h.nodes[userID] {
+		if presenceRank[p.status] > presenceRank[status] {
+			status = p.status
+		}
+	}
+
+	previous, ok := h.presence[userID]
+	if !ok {
+		previous = PresenceOffline
+	}
+	if status == previous {
+		return
+	}
+	if status == PresenceOffline {
+		delete(h.presence, userID)
+	} else {
+		h.presence[userID] = status
+	}
+
+	select {
+	case h.presenceChanges <- PresenceChange{UserID: userID, Status: status, LastSeen: h.lastSeen[userID]}:
+	default:
+		log.Printf("Presence queue full, dropped %s for user %d", status, userID)
+	}
+}
+
+// queuePresenceEvent hands an event to publishPresence without blocking
+// the Run goroutine. The caller must hold h.mu.
+func (h *Hub) queuePresenceEvent(event presenceEvent) {
+	select {
+	case h.presenceOut <- event:
+	default:
+		log.Printf("Presence outbox full, dropped %s for user %d", event.Status, event.UserID)
+	}
+}
+
+// publishPresence publishes the events queued by the Run goroutine.
+func (h *Hub) publishPresence(ctx context.Context) {
+	for event := range h.presenceOut {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Println("Failed to encode presence event:", err)
+			continue
+		}
+		if err := h.broker.Publish(ctx, brokerPresenceChannel, payload); err != nil {
+			log.Printf("Failed to publish presence of user %d: %v", event.UserID, err)
+		}
+	}
+}
+
+// Touch records activity on a client, bringing an away user back online.
+func (h *Hub) Touch(client *Client) {
+	client.touch()
+	if h.Presence(client.userID).Status == PresenceAway {
+		select {
+		case h.activity <- client.userID:
+		default:
+		}
+	}
+}
+
+// Presence returns the current status of a user.
+func (h *Hub) Presence(userID uint) PresencePayload {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	payload := PresencePayload{UserID: userID, Status: PresenceOffline}
+	if status, ok := h.presence[userID]; ok {
+		payload.Status = status
+	}
+	if lastSeen, ok := h.lastSeen[userID]; ok {
+		payload.LastSeen = &lastSeen
+	}
+	return payload
+}
+
+// PresenceChanges streams status changes in the order they happened.
+func (h *Hub) PresenceChanges() <-chan PresenceChange {
+	return h.presenceChanges
+}
+
+// PublishPresence reports every presence change to the local clients of
+// the rooms the user belongs to. It runs until the process exits.
+func (wsh *WebSocketHandler) PublishPresence() {
+	for change := range wsh.hub.PresenceChanges() {
+		roomIDs, err := wsh.roomRepo.FindIDsByUser(change.UserID)
+		if err != nil {
+			log.Printf("Failed to load rooms of user %d: %v", change.UserID, err)
+			continue
+		}
+
+		lastSeen := change.LastSeen
+		payload := PresencePayload{UserID: change.UserID, Status: change.Status, LastSeen: &lastSeen}
+		for _, roomID := range roomIDs {
+			data, err := newEnvelope(TypePresence, "", roomID, payload)
+			if err != nil {
+				log.Println("Failed to encode presence frame:", err)
+				break
+			}
+			wsh.hub.broadcastLocal(roomID, data)
+		}
+	}
+}
+
+type PresenceHandler struct {
+	hub      *Hub
+	roomRepo models.RoomRepository
+}
+
+func NewPresenceHandler(hub *Hub, roomRepo models.RoomRepository) *PresenceHandler {
+	return &PresenceHandler{hub: hub, roomRepo: roomRepo}
+}
+
+// GetRoomPresence godoc
+// @Summary Get room presence
+// @Schemes
+// @Description Get the online/away/offline status of every member of a room
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 200 {array} PresencePayload
+// @Router /rooms/{id}/presence [get]
+func (h *PresenceHandler) GetRoomPresence(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	room, err := h.roomRepo.FindByID(uint(roomID))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	isMember, err := h.roomRepo.IsMember(room.ID, currentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !isMember {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+		return
+	}
+
+	presence := make([]PresencePayload, 0, len(room.Users))
+	for _, user := range room.Users {
+		presence = append(presence, h.hub.Presence(user.ID))
+	}
+
+	c.JSON(http.StatusOK, presence)
+}
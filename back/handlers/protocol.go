@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ProtocolVersion is the envelope version spoken on /ws. The schema is
+// published at /ws/schema (docs/websocket.schema.json).
+const ProtocolVersion = 1
+
+// Frame types.
+const (
+	TypeChatMessage = "chat_message"
+	TypeJoinRoom    = "join_room"
+	TypeLeaveRoom   = "leave_room"
+	TypeTypingStart = "typing_start"
+	TypeTypingStop  = "typing_stop"
+	TypeAck         = "ack"
+	TypeError       = "error"
+	TypePresence    = "presence"
+	TypeMarkRead    = "mark_read"
+	TypeReadReceipt = "read_receipt"
+	TypeResume      = "resume"
+	TypeResync      = "resync_required"
+
+	TypeEditMessage    = "edit_message"
+	TypeDeleteMessage  = "delete_message"
+	TypeMessageUpdated = "message_updated"
+	TypeMessageDeleted = "message_deleted"
+
+	TypeJoinThread    = "join_thread"
+	TypeLeaveThread   = "leave_thread"
+	TypeThreadUpdated = "thread_updated"
+
+	TypeAddReaction     = "add_reaction"
+	TypeRemoveReaction  = "remove_reaction"
+	TypeReactionAdded   = "reaction_added"
+	TypeReactionRemoved = "reaction_removed"
+
+	TypeMention = "mention"
+
+	TypeRoomUpdated = "room_updated"
+	TypeRoomDeleted = "room_deleted"
+	TypeMemberLeft  = "member_left"
+
+	TypeMemberUpdated = "member_updated"
+	TypeMemberKicked  = "member_kicked"
+
+	TypeInvitation = "invitation"
+
+	TypeJoinRequest        = "join_request"
+	TypeJoinRequestUpdated = "join_request_updated"
+
+	TypeMemberBanned  = "member_banned"
+	TypeMemberMuted   = "member_muted"
+	TypeMemberUnmuted = "member_unmuted"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrCodeInvalidJSON        = "invalid_json"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeRoomRequired       = "room_required"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInternal           = "internal_error"
+)
+
+// Envelope wraps every frame exchanged over /ws, in both directions.
+// ID is chosen by the sender; replies (ack, error) echo the ID of the
+// frame they answer.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	RoomID  uint            `json:"room_id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	TS      time.Time       `json:"ts"`
+}
+
+// ChatMessagePayload is sent by clients to post a message. Broadcast
+// chat_message frames carry a models.Message instead. ClientMsgID is an
+// optional idempotency key chosen by the client, unique per user.
+// ParentID posts the message as a reply in the thread of that message.
+type ChatMessagePayload struct {
+	Content     string `json:"content"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	ParentID    uint   `json:"parent_id,omitempty"`
+}
+
+// ThreadPayload selects the thread of a message.
+type ThreadPayload struct {
+	MessageID uint `json:"message_id"`
+}
+
+// ThreadSummaryPayload tells a room that the thread started by MessageID
+// has new replies.
+type ThreadSummaryPayload struct {
+	MessageID   uint       `json:"message_id"`
+	ReplyCount  int        `json:"reply_count"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+}
+
+// MessageAckPayload is carried by the ack of a chat_message frame so the
+// sender can reconcile its optimistic copy with the stored message. Seq
+// is the position of a reply within its thread.
+type MessageAckPayload struct {
+	MessageID   uint      `json:"message_id"`
+	Seq         uint64    `json:"seq"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// EditMessagePayload replaces the content of one of the sender's messages.
+type EditMessagePayload struct {
+	MessageID uint   `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+// DeleteMessagePayload deletes one of the sender's messages, or as a
+// moderator of a room any message in it.
+type DeleteMessagePayload struct {
+	MessageID uint `json:"message_id"`
+}
+
+// ReactionPayload adds or removes the sender's reaction with Emoji, a
+// unicode emoji or a custom :shortcode:, on a message.
+type ReactionPayload struct {
+	MessageID uint   `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionEventPayload tells a room that UserID added or removed a
+// reaction; Count is how many users now reacted with Emoji.
+type ReactionEventPayload struct {
+	MessageID uint   `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	UserID    uint   `json:"user_id"`
+	Count     int64  `json:"count"`
+}
+
+// MarkReadPayload marks every message up to MessageID in room_id as read.
+type MarkReadPayload struct {
+	MessageID uint `json:"message_id"`
+}
+
+// ResumePayload is sent after a reconnect with the last seq the client saw
+// in each room it wants back, keyed by room ID.
+type ResumePayload struct {
+	Rooms map[uint]uint64 `json:"rooms"`
+}
+
+// ResyncPayload tells the client that too many messages were missed in
+// room_id to replay; it should refetch the history over REST.
+type ResyncPayload struct {
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// ErrorPayload describes why a frame was rejected.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// frameHandler processes one inbound frame type.
+type frameHandler struct {
+	// requiresRoom rejects frames that do not carry a room_id.
+	requiresRoom bool
+	handle       func(wsh *WebSocketHandler, client *Client, env *Envelope) error
+}
+
+// frameHandlers is the registry of frame types accepted from clients.
+var frameHandlers = map[string]frameHandler{
+	TypeChatMessage: {requiresRoom: true, handle: (*WebSocketHandler).handleChatMessage},
+	TypeJoinRoom:    {requiresRoom: true, handle: (*WebSocketHandler).handleJoinRoom},
+	TypeLeaveRoom:   {requiresRoom: true, handle: (*WebSocketHandler).handleLeaveRoom},
+	TypeTypingStart: {requiresRoom: true, handle: (*WebSocketHandler).handleTypingStart},
+	TypeTypingStop:  {requiresRoom: true, handle: (*WebSocketHandler).handleTypingStop},
+	TypeMarkRead:    {requiresRoom: true, handle: (*WebSocketHandler).handleMarkRead},
+	TypeResume:      {handle: (*WebSocketHandler).handleResume},
+	TypeAck:         {handle: (*WebSocketHandler).handleClientAck},
+	TypeError:       {handle: (*WebSocketHandler).handleClientError},
+
+	TypeEditMessage:   {handle: (*WebSocketHandler).handleEditMessage},
+	TypeDeleteMessage: {handle: (*WebSocketHandler).handleDeleteMessage},
+	TypeJoinThread:    {handle: (*WebSocketHandler).handleJoinThread},
+	TypeLeaveThread:   {handle: (*WebSocketHandler).handleLeaveThread},
+
+	TypeAddReaction:    {handle: (*WebSocketHandler).handleAddReaction},
+	TypeRemoveReaction: {handle: (*WebSocketHandler).handleRemoveReaction},
+}
+
+// decodeEnvelope strictly parses an inbound frame.
+func decodeEnvelope(data []byte) (*Envelope, error) {
+	var env Envelope
+	if err := strictUnmarshal(data, &env); err != nil {
+		return nil, newChatError(ErrCodeInvalidJSON, "Invalid frame: "+err.Error())
+	}
+	if env.V != ProtocolVersion {
+		return &env, newChatError(ErrCodeUnsupportedVersion, "Unsupported protocol version")
+	}
+	if env.Type == "" {
+		return &env, newChatError(ErrCodeInvalidPayload, "Frame type is required")
+	}
+	return &env, nil
+}
+
+// decodePayload strictly parses the envelope payload into v. A missing
+// payload decodes as the zero value.
+func decodePayload(env *Envelope, v interface{}) error {
+	if len(env.Payload) == 0 || bytes.Equal(env.Payload, []byte("null")) {
+		return nil
+	}
+	if err := strictUnmarshal(env.Payload, v); err != nil {
+		return newChatError(ErrCodeInvalidPayload, "Invalid payload: "+err.Error())
+	}
+	return nil
+}
+
+// strictUnmarshal is json.Unmarshal that rejects unknown fields and
+// trailing data.
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// newEnvelope builds an outbound frame.
+func newEnvelope(frameType string, id string, roomID uint, payload interface{}) ([]byte, error) {
+	env := Envelope{V: ProtocolVersion, Type: frameType, ID: id, RoomID: roomID, TS: time.Now().UTC()}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+	return json.Marshal(env)
+}
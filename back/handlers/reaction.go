@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"quickstart/models"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxReactionEmoji caps the distinct emoji on one message.
+	maxReactionEmoji = 20
+	// maxEmojiRunes leaves room for ZWJ sequences such as family emoji.
+	maxEmojiRunes = 16
+)
+
+// shortcodePattern matches custom emoji such as :party_parrot:.
+var shortcodePattern = regexp.MustCompile(`^:[a-z0-9_+-]{1,32}:$`)
+
+// normalizeEmoji validates a reaction emoji: a single unicode emoji,
+// possibly a sequence with modifiers, or a custom :shortcode:, which is
+// lowercased.
+func normalizeEmoji(emoji string) (string, error) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" {
+		return "", newChatError(ErrCodeInvalidPayload, "emoji is required")
+	}
+	if strings.HasPrefix(emoji, ":") {
+		emoji = strings.ToLower(emoji)
+		if !shortcodePattern.MatchString(emoji) {
+			return "", newChatError(ErrCodeInvalidPayload, "Invalid emoji shortcode")
+		}
+		return emoji, nil
+	}
+
+	if utf8.RuneCountInString(emoji) > maxEmojiRunes {
+		return "", newChatError(ErrCodeInvalidPayload, "Invalid emoji")
+	}
+	symbol := false
+	for _, r := range emoji {
+		switch {
+		case unicode.Is(unicode.So, r), r == '\u20e3': // symbols, combining keycap
+			symbol = true
+		case unicode.Is(unicode.Sk, r): // skin tone modifiers
+		case r == '\u200d', r == '\ufe0e', r == '\ufe0f': // joiner, variation selectors
+		case r >= '\U000e0020' && r <= '\U000e007f': // subdivision flag tags
+		case r >= '0' && r <= '9', r == '#', r == '*': // keycap bases
+		default:
+			return "", newChatError(ErrCodeInvalidPayload, "Invalid emoji")
+		}
+	}
+	if !symbol {
+		return "", newChatError(ErrCodeInvalidPayload, "Invalid emoji")
+	}
+	return emoji, nil
+}
+
+// AddReaction adds the user's reaction with emoji to a message and
+// broadcasts reaction_added to whoever receives the message. Reacting
+// twice with the same emoji changes nothing. It returns the reactions of
+// the message as seen by the user.
+func (s *ChatService) AddReaction(user *models.User, messageID uint, emoji string) ([]models.ReactionSummary, error) {
+	emoji, err := normalizeEmoji(emoji)
+	if err != nil {
+		return nil, err
+	}
+	message, err := s.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireWritable(user.ID, message.RoomID); err != nil {
+		return nil, err
+	}
+
+	added, err := s.reactionRepo.Add(&models.Reaction{MessageID: message.ID, UserID: user.ID, Emoji: emoji}, maxReactionEmoji)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyReactions) {
+			return nil, newChatError(ErrCodeInvalidPayload, "This message has too many different reactions")
+		}
+		return nil, err
+	}
+	if added {
+		if err := s.broadcastReaction(TypeReactionAdded, message, user.ID, emoji); err != nil {
+			return nil, err
+		}
+	}
+	return s.messageReactions(user.ID, message.ID)
+}
+
+// RemoveReaction removes the user's reaction with emoji from a message
+// and broadcasts reaction_removed if there was one.
+func (s *ChatService) RemoveReaction(user *models.User, messageID uint, emoji string) ([]models.ReactionSummary, error) {
+	emoji, err := normalizeEmoji(emoji)
+	if err != nil {
+		return nil, err
+	}
+	message, err := s.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireWritable(user.ID, message.RoomID); err != nil {
+		return nil, err
+	}
+
+	removed, err := s.reactionRepo.Remove(message.ID, user.ID, emoji)
+	if err != nil {
+		return nil, err
+	}
+	if removed {
+		if err := s.broadcastReaction(TypeReactionRemoved, message, user.ID, emoji); err != nil {
+			return nil, err
+		}
+	}
+	return s.messageReactions(user.ID, message.ID)
+}
+
+// broadcastReaction sends a reaction delta with the new count for emoji.
+func (s *ChatService) broadcastReaction(frameType string, message *models.Message, userID uint, emoji string) error {
+	count, err := s.reactionRepo.Count(message.ID, emoji)
+	if err != nil {
+		return err
+	}
+	data, err := newEnvelope(frameType, "", message.RoomID, ReactionEventPayload{
+		MessageID: message.ID,
+		Emoji:     emoji,
+		UserID:    userID,
+		Count:     count,
+	})
+	if err != nil {
+		return err
+	}
+	return s.broadcastAbout(message, data)
+}
+
+func (s *ChatService) messageReactions(userID uint, messageID uint) ([]models.ReactionSummary, error) {
+	summaries, err := s.reactionRepo.Summarize([]uint{messageID}, userID)
+	if err != nil {
+		return nil, err
+	}
+	if summaries[messageID] == nil {
+		return []models.ReactionSummary{}, nil
+	}
+	return summaries[messageID], nil
+}
+
+// LoadReactions fills in the reactions of messages as seen by userID.
+func (s *ChatService) LoadReactions(userID uint, messages []models.Message) error {
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+	summaries, err := s.reactionRepo.Summarize(ids, userID)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = summaries[messages[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBroker is a Broker on Redis pub/sub, for running several instances
+// behind a load balancer. Channel names are namespaced with prefix so
+// several deployments can share one Redis.
+type redisBroker struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisBroker connects to the Redis server at url, such as
+// redis://localhost:6379/0.
+func NewRedisBroker(url string, prefix string) (Broker, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisBroker{client: client, prefix: prefix}, nil
+}
+
+func (b *redisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.client.Publish(ctx, b.prefix+channel, payload).Err()
+}
+
+// Subscribe returns once Redis confirmed the subscription, so nothing
+// published afterwards is missed. go-redis resubscribes after a dropped
+// connection; messages published meanwhile are lost, as with any Redis
+// pub/sub consumer.
+func (b *redisBroker) Subscribe(ctx context.Context, channels ...string) (<-chan BrokerMessage, error) {
+	names := make([]string, len(channels))
+	for i, channel := range channels {
+		names[i] = b.prefix + channel
+	}
+
+	pubsub := b.client.Subscribe(ctx, names...)
+	for range names {
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return nil, err
+		}
+	}
+
+	out := make(chan BrokerMessage, 256)
+	go func() {
+		defer close(out)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				out <- BrokerMessage{
+					Channel: strings.TrimPrefix(msg.Channel, b.prefix),
+					Payload: []byte(msg.Payload),
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *redisBroker) Close() error {
+	return b.client.Close()
+}
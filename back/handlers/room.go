@@ -4,70 +4,182 @@ import (
 	"net/http"
 	"quickstart/models"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
+// maxGroupMembers caps the members of a group DM, the current user
+// included. Larger groups should be promoted to a room.
+const maxGroupMembers = 10
+
 type RoomHandler struct {
     roomRepo models.RoomRepository
+    readRepo models.ReadStateRepository
+    chat     *ChatService
+}
+
+// RoomSummary is a room as listed for the current user, with their
+// unread badge.
+type RoomSummary struct {
+    models.Room
+    UnreadCount       int64 `json:"unread_count"`
+    LastReadMessageID uint  `json:"last_read_message_id"`
+}
+
+type CreateRoomRequest struct {
+    Name        string `json:"name" binding:"required"`
+    Description string `json:"description"`
+    // Visibility defaults to public when empty.
+    Visibility string `json:"visibility" binding:"omitempty,oneof=public restricted private"`
+}
+
+type UpdateRoomRequest struct {
+    Name        string `json:"name" binding:"required"`
+    Description string `json:"description"`
+    // Visibility is left unchanged when empty.
+    Visibility string `json:"visibility" binding:"omitempty,oneof=public restricted private"`
+}
+
+type SetRoleRequest struct {
+    Role string `json:"role" binding:"required,oneof=moderator member"`
+}
+
+type TransferOwnershipRequest struct {
+    UserID uint `json:"user_id" binding:"required"`
+}
+
+type OpenDMRequest struct {
+    UserID uint `json:"user_id" binding:"required"`
+}
+
+type CreateGroupRequest struct {
+    UserIDs []uint `json:"user_ids" binding:"required,min=2"`
+}
+
+type AddParticipantsRequest struct {
+    UserIDs []uint `json:"user_ids" binding:"required,min=1"`
+    // ShareHistory adds the users to the conversation itself. Otherwise a
+    // new group is started with everyone, leaving the old one as it is.
+    ShareHistory bool `json:"share_history"`
+}
+
+type PromoteGroupRequest struct {
+    Name        string `json:"name" binding:"required"`
+    Description string `json:"description"`
 }
 
-func NewRoomHandler(roomRepo models.RoomRepository) *RoomHandler {
-    return &RoomHandler{roomRepo: roomRepo}
+func NewRoomHandler(roomRepo models.RoomRepository, readRepo models.ReadStateRepository, chat *ChatService) *RoomHandler {
+    return &RoomHandler{roomRepo: roomRepo, readRepo: readRepo, chat: chat}
 }
 
 // CreateRoom godoc
 // @Summary Create a new room
 // @Schemes
-// @Description Create a new chat room
+// @Description Create a new chat room, public unless visibility is restricted or private. The current user becomes its owner and only member.
 // @Tags rooms
 // @Accept json
 // @Produce json
-// @Param room body models.Room true "Room object"
+// @Security BearerAuth
+// @Param room body CreateRoomRequest true "Room name, description and visibility"
 // @Success 201 {object} models.Room
 // @Router /rooms [post]
 func (h *RoomHandler) CreateRoom(c *gin.Context) {
-    var room models.Room
-    if err := c.ShouldBindJSON(&room); err != nil {
+    var req CreateRoomRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
+    name := strings.TrimSpace(req.Name)
+    if name == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Room name is required"})
+        return
+    }
+    visibility := req.Visibility
+    if visibility == "" {
+        visibility = models.VisibilityPublic
+    }
+
+    room := models.Room{Name: name, Description: req.Description, Kind: models.RoomKindRoom, Visibility: visibility}
+    if err := h.roomRepo.Create(&room, currentUser(c).ID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
     
-    if err := h.roomRepo.Create(&room); err != nil {
+    created, err := h.roomRepo.FindByID(room.ID)
+    if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
     
-    c.JSON(http.StatusCreated, room)
+    c.JSON(http.StatusCreated, created)
 }
 
 // GetRooms godoc
 // @Summary Get all rooms
 // @Schemes
-// @Description Get all chat rooms
+// @Description Get all chat rooms, with the current user's unread count and last read message in the rooms they belong to. Private rooms are only listed for their members. Direct message conversations are listed by GET /dms instead. Archived rooms are left out unless archived is true.
 // @Tags rooms
 // @Accept json
 // @Produce json
-// @Success 200 {array} models.Room
+// @Security BearerAuth
+// @Param archived query bool false "Include archived rooms"
+// @Success 200 {array} RoomSummary
 // @Router /rooms [get]
 func (h *RoomHandler) GetRooms(c *gin.Context) {
-    rooms, err := h.roomRepo.FindAll()
+    includeArchived, err := strconv.ParseBool(c.DefaultQuery("archived", "false"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid archived flag"})
+        return
+    }
+
+    rooms, err := h.roomRepo.FindAll(currentUser(c).ID, includeArchived)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    result, err := h.summarize(currentUser(c).ID, rooms)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
     
-    c.JSON(http.StatusOK, rooms)
+    c.JSON(http.StatusOK, result)
+}
+
+// summarize adds the user's unread badges to rooms.
+func (h *RoomHandler) summarize(userID uint, rooms []models.Room) ([]RoomSummary, error) {
+    summaries, err := h.readRepo.FindSummaries(userID)
+    if err != nil {
+        return nil, err
+    }
+    byRoom := make(map[uint]models.RoomReadSummary, len(summaries))
+    for _, summary := range summaries {
+        byRoom[summary.RoomID] = summary
+    }
+
+    result := make([]RoomSummary, 0, len(rooms))
+    for _, room := range rooms {
+        summary := byRoom[room.ID]
+        result = append(result, RoomSummary{
+            Room:              room,
+            UnreadCount:       summary.UnreadCount,
+            LastReadMessageID: summary.LastReadMessageID,
+        })
+    }
+    return result, nil
 }
 
 // GetRoom godoc
 // @Summary Get a room by ID
 // @Schemes
-// @Description Get a room by ID with users
+// @Description Get a room by ID with users. Private rooms and direct message conversations are only visible to their members.
 // @Tags rooms
 // @Accept json
 // @Produce json
+// @Security BearerAuth
 // @Param id path int true "Room ID"
 // @Success 200 {object} models.Room
 // @Router /rooms/{id} [get]
@@ -88,17 +200,32 @@ func (h *RoomHandler) GetRoom(c *gin.Context) {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
+    if room.IsPrivate() && !hasMember(room, currentUser(c).ID) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+        return
+    }
     
     c.JSON(http.StatusOK, room)
 }
 
+// hasMember reports whether the user is among the loaded members of room.
+func hasMember(room *models.Room, userID uint) bool {
+    for _, user := range room.Users {
+        if user.ID == userID {
+            return true
+        }
+    }
+    return false
+}
+
 // JoinRoom godoc
 // @Summary Join a room
 // @Schemes
-// @Description Add user to a room
+// @Description Join a public room. userId must be the current user; other users are invited with POST /rooms/{roomId}/invitations. Restricted rooms are joined with POST /rooms/{roomId}/join-requests, and private rooms only by invitation or invite link.
 // @Tags rooms
 // @Accept json
 // @Produce json
+// @Security BearerAuth
 // @Param roomId path int true "Room ID"
 // @Param userId path int true "User ID"
 // @Success 200 {object} models.Room
@@ -119,21 +246,605 @@ func (h *RoomHandler) JoinRoom(c *gin.Context) {
         return
     }
     
+    room, err := h.roomRepo.FindByID(uint(roomId))
+    if err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Room or User not found"})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if room.IsConversation() {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Cannot join a direct message conversation"})
+        return
+    }
+    if room.IsPrivate() && !hasMember(room, currentUser(c).ID) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Room or User not found"})
+        return
+    }
+    if uint(userId) != currentUser(c).ID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Invite other users instead of adding them"})
+        return
+    }
+    if room.IsArchived() {
+        c.JSON(http.StatusForbidden, gin.H{"error": "This room is archived"})
+        return
+    }
+    if !room.IsOpen() && !hasMember(room, currentUser(c).ID) {
+        c.JSON(http.StatusForbidden, gin.H{"error": "This room requires approval, send a join request instead"})
+        return
+    }
+    
     if err := h.roomRepo.AddUser(uint(roomId), uint(userId)); err != nil {
         if err == gorm.ErrRecordNotFound {
             c.JSON(http.StatusNotFound, gin.H{"error": "Room or User not found"})
             return
         }
+        if err == models.ErrBanned {
+            c.JSON(http.StatusForbidden, gin.H{"error": "Banned from this room"})
+            return
+        }
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
     
     // Load updated room with users
-    room, err := h.roomRepo.FindByID(uint(roomId))
+    room, err = h.roomRepo.FindByID(uint(roomId))
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
     
     c.JSON(http.StatusOK, room)
-}
\ No newline at end of file
+}
+
+// UpdateRoom godoc
+// @Summary Update a room
+// @Schemes
+// @Description Rename a room or change its description and broadcast room_updated to it. Only its moderators and owner can update a room, and only the owner can change its visibility. Archived rooms cannot be updated.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param room body UpdateRoomRequest true "Room name and description"
+// @Success 200 {object} models.Room
+// @Router /rooms/{id} [put]
+func (h *RoomHandler) UpdateRoom(c *gin.Context) {
+    roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return
+    }
+
+    var req UpdateRoomRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    room, err := h.chat.UpdateRoom(currentUser(c), uint(roomID), req.Name, req.Description, req.Visibility)
+    if err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, room)
+}
+
+// DeleteRoom godoc
+// @Summary Delete a room
+// @Schemes
+// @Description Delete a room with its whole history. Its subscribers get room_deleted and are unsubscribed. Archive the room instead to keep the history. Only the owner can delete a room.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 204
+// @Router /rooms/{id} [delete]
+func (h *RoomHandler) DeleteRoom(c *gin.Context) {
+    roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return
+    }
+
+    if err := h.chat.DeleteRoom(currentUser(c), uint(roomID)); err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.Status(http.StatusNoContent)
+}
+
+// ArchiveRoom godoc
+// @Summary Archive a room
+// @Schemes
+// @Description Make a room read-only and hide it from GET /rooms, keeping its members and history, and broadcast room_updated to it. Only the owner can archive a room.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Success 200 {object} models.Room
+// @Router /rooms/{roomId}/archive [post]
+func (h *RoomHandler) ArchiveRoom(c *gin.Context) {
+    h.setArchived(c, true)
+}
+
+// UnarchiveRoom godoc
+// @Summary Unarchive a room
+// @Schemes
+// @Description Restore an archived room and broadcast room_updated to it. Only the owner can restore a room.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Success 200 {object} models.Room
+// @Router /rooms/{roomId}/unarchive [post]
+func (h *RoomHandler) UnarchiveRoom(c *gin.Context) {
+    h.setArchived(c, false)
+}
+
+func (h *RoomHandler) setArchived(c *gin.Context, archived bool) {
+    roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return
+    }
+
+    room, err := h.chat.SetArchived(currentUser(c), uint(roomID), archived)
+    if err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, room)
+}
+
+// LeaveRoom godoc
+// @Summary Leave a room
+// @Schemes
+// @Description Leave a room or group conversation. The room gets member_left and the current user's connections are unsubscribed from it. Messages already sent stay. 1:1 conversations cannot be left, and the owner of a room must transfer ownership first, or delete the room if nobody else is in it.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Success 204
+// @Router /rooms/{roomId}/leave [post]
+func (h *RoomHandler) LeaveRoom(c *gin.Context) {
+    roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return
+    }
+
+    if err := h.chat.LeaveRoom(currentUser(c), uint(roomID)); err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.Status(http.StatusNoContent)
+}
+
+// GetRoomMembers godoc
+// @Summary Get the members of a room
+// @Schemes
+// @Description Get the members of a room with their roles, the owner first, then moderators, then members in the order they joined
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 200 {array} models.RoomMember
+// @Router /rooms/{id}/members [get]
+func (h *RoomHandler) GetRoomMembers(c *gin.Context) {
+    roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return
+    }
+
+    members, err := h.chat.Members(currentUser(c), uint(roomID))
+    if err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, members)
+}
+
+// SetMemberRole godoc
+// @Summary Change the role of a room member
+// @Schemes
+// @Description Make a member a moderator or a plain member again and broadcast member_updated to the room. Only the owner can change roles; use POST /rooms/{roomId}/transfer to hand over ownership.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param userId path int true "User ID"
+// @Param role body SetRoleRequest true "New role"
+// @Success 200 {object} models.RoomMember
+// @Router /rooms/{id}/members/{userId} [put]
+func (h *RoomHandler) SetMemberRole(c *gin.Context) {
+    roomID, userID, ok := parseMemberParams(c)
+    if !ok {
+        return
+    }
+
+    var req SetRoleRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    member, err := h.chat.SetRole(currentUser(c), roomID, userID, req.Role)
+    if err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, member)
+}
+
+// KickMember godoc
+// @Summary Remove a member from a room
+// @Schemes
+// @Description Remove a member from a room. The room gets member_kicked and the member's connections are unsubscribed from it. Kicked members can join again; ban them to keep them out. Moderators can remove members; the owner can remove anyone. The kick is recorded in the audit log with the reason.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param userId path int true "User ID"
+// @Param reason query string false "Why the member is removed"
+// @Success 204
+// @Router /rooms/{id}/members/{userId} [delete]
+func (h *RoomHandler) KickMember(c *gin.Context) {
+    roomID, userID, ok := parseMemberParams(c)
+    if !ok {
+        return
+    }
+
+    if err := h.chat.KickMember(currentUser(c), roomID, userID, c.Query("reason")); err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.Status(http.StatusNoContent)
+}
+
+// TransferOwnership godoc
+// @Summary Transfer ownership of a room
+// @Schemes
+// @Description Make another member the owner of a room. The current owner becomes a moderator. Both changes are broadcast as member_updated.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param owner body TransferOwnershipRequest true "New owner"
+// @Success 200 {array} models.RoomMember
+// @Router /rooms/{roomId}/transfer [post]
+func (h *RoomHandler) TransferOwnership(c *gin.Context) {
+    roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return
+    }
+
+    var req TransferOwnershipRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    members, err := h.chat.TransferOwnership(currentUser(c), uint(roomID), req.UserID)
+    if err != nil {
+        respondChatError(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, members)
+}
+
+// parseMemberParams reads the id and userId path parameters of the member
+// endpoints.
+func parseMemberParams(c *gin.Context) (uint, uint, bool) {
+    roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return 0, 0, false
+    }
+    userID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+        return 0, 0, false
+    }
+    return uint(roomID), uint(userID), true
+}
+
+// OpenDM godoc
+// @Summary Open a direct message conversation
+// @Schemes
+// @Description Get the direct message conversation between the current user and another user, creating it on first use. Messages, read receipts and typing work as in rooms, using the conversation's room ID.
+// @Tags dms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param dm body OpenDMRequest true "Other user"
+// @Success 200 {object} models.Room
+// @Success 201 {object} models.Room
+// @Router /dms [post]
+func (h *RoomHandler) OpenDM(c *gin.Context) {
+    var req OpenDMRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    user := currentUser(c)
+    if req.UserID == user.ID {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot open a conversation with yourself"})
+        return
+    }
+
+    room, created, err := h.roomRepo.FindOrCreateDM(user.ID, req.UserID)
+    if err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    status := http.StatusOK
+    if created {
+        status = http.StatusCreated
+    }
+    c.JSON(status, room)
+}
+
+// GetDMs godoc
+// @Summary Get direct message conversations
+// @Schemes
+// @Description Get the current user's 1:1 and group conversations, told apart by kind, with their unread count and last read message
+// @Tags dms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} RoomSummary
+// @Router /dms [get]
+func (h *RoomHandler) GetDMs(c *gin.Context) {
+    user := currentUser(c)
+    rooms, err := h.roomRepo.FindDMsByUser(user.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    result, err := h.summarize(user.ID, rooms)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, result)
+}
+
+// CreateGroupDM godoc
+// @Summary Start a group conversation
+// @Schemes
+// @Description Start an unnamed group conversation between the current user and at least two other users, up to 10 members in total. Every call starts a new conversation. It is listed by GET /dms with kind "group".
+// @Tags dms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param group body CreateGroupRequest true "Other members"
+// @Success 201 {object} models.Room
+// @Router /dms/groups [post]
+func (h *RoomHandler) CreateGroupDM(c *gin.Context) {
+    var req CreateGroupRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    userIDs := appendNewIDs([]uint{currentUser(c).ID}, req.UserIDs)
+    if len(userIDs) < 3 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "A group needs at least two other members; use POST /dms for a 1:1 conversation"})
+        return
+    }
+    if len(userIDs) > maxGroupMembers {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Too many members for a group conversation"})
+        return
+    }
+
+    room, err := h.roomRepo.CreateGroup(userIDs)
+    if err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusCreated, room)
+}
+
+// AddParticipants godoc
+// @Summary Add people to a conversation
+// @Schemes
+// @Description Add users to a 1:1 or group conversation. With share_history the users join the group itself and see its whole history; the group and the added users get room_updated. Without it a new group conversation is started with the current members and the new users, and the old conversation is left unchanged; this is always the case for 1:1 conversations.
+// @Tags dms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Conversation room ID"
+// @Param participants body AddParticipantsRequest true "Users to add"
+// @Success 200 {object} models.Room "The conversation, with history shared"
+// @Success 201 {object} models.Room "The new conversation"
+// @Router /dms/{roomId}/participants [post]
+func (h *RoomHandler) AddParticipants(c *gin.Context) {
+    room, ok := h.findConversation(c)
+    if !ok {
+        return
+    }
+
+    var req AddParticipantsRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    memberIDs := make([]uint, 0, len(room.Users))
+    for _, user := range room.Users {
+        memberIDs = append(memberIDs, user.ID)
+    }
+    userIDs := appendNewIDs(memberIDs, req.UserIDs)
+    if len(userIDs) == len(memberIDs) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Everyone is already in this conversation"})
+        return
+    }
+    if len(userIDs) > maxGroupMembers {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Too many members for a group conversation; promote it to a room instead"})
+        return
+    }
+
+    if !req.ShareHistory {
+        group, err := h.roomRepo.CreateGroup(userIDs)
+        if err != nil {
+            if err == gorm.ErrRecordNotFound {
+                c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+                return
+            }
+            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(http.StatusCreated, group)
+        return
+    }
+
+    if room.IsDM() {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "The history of a 1:1 conversation cannot be shared"})
+        return
+    }
+    newIDs := userIDs[len(memberIDs):]
+    if err := h.roomRepo.AddUsers(room.ID, newIDs); err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    room, err := h.roomRepo.FindByID(room.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if err := h.chat.announceNewMembers(room, newIDs); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusOK, room)
+}
+
+// PromoteGroup godoc
+// @Summary Promote a group conversation to a room
+// @Schemes
+// @Description Turn a group conversation into a regular named room. It keeps its ID, members and messages, and stays private: only its members see it until the owner changes its visibility. The current user becomes its owner. The room gets room_updated.
+// @Tags dms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Conversation room ID"
+// @Param room body PromoteGroupRequest true "Room name and description"
+// @Success 200 {object} models.Room
+// @Router /dms/{roomId}/promote [post]
+func (h *RoomHandler) PromoteGroup(c *gin.Context) {
+    room, ok := h.findConversation(c)
+    if !ok {
+        return
+    }
+    if room.Kind != models.RoomKindGroup {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Only group conversations can be promoted to a room"})
+        return
+    }
+
+    var req PromoteGroupRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    name := strings.TrimSpace(req.Name)
+    if name == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Room name is required"})
+        return
+    }
+
+    room.Name = name
+    room.Description = req.Description
+    room.Kind = models.RoomKindRoom
+    // The history was written for the group alone; opening it up is the
+    // owner's call.
+    room.Visibility = models.VisibilityPrivate
+    if err := h.roomRepo.Promote(room, currentUser(c).ID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if err := h.chat.broadcastRoomUpdated(room); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, room)
+}
+
+// findConversation loads the 1:1 or group DM named by the roomId path
+// parameter. Other rooms and conversations the current user is not in are
+// reported as not found.
+func (h *RoomHandler) findConversation(c *gin.Context) (*models.Room, bool) {
+    roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+        return nil, false
+    }
+
+    room, err := h.roomRepo.FindByID(uint(roomID))
+    if err != nil {
+        if err == gorm.ErrRecordNotFound {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+            return nil, false
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return nil, false
+    }
+    if !room.IsConversation() || !hasMember(room, currentUser(c).ID) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+        return nil, false
+    }
+    return room, true
+}
+
+// appendNewIDs appends the IDs that are not in ids yet, once each.
+func appendNewIDs(ids []uint, more []uint) []uint {
+    seen := make(map[uint]bool, len(ids)+len(more))
+    for _, id := range ids {
+        seen[id] = true
+    }
+    for _, id := range more {
+        if !seen[id] {
+            seen[id] = true
+            ids = append(ids, id)
+        }
+    }
+    return ids
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"quickstart/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemberPayload names the member a room event is about, and for
+// moderation the moderator who acted and their reason.
+type MemberPayload struct {
+	UserID uint   `json:"user_id"`
+	By     uint   `json:"by,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// memberRoom loads a room the user belongs to and their membership.
+// Conversations the user is not in are reported as not found.
+func (s *ChatService) memberRoom(userID uint, roomID uint) (*models.Room, *models.RoomMember, error) {
+	room, err := s.roomRepo.FindByID(roomID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, newChatError(ErrCodeNotFound, "Room not found")
+		}
+		return nil, nil, err
+	}
+	member, err := s.roomRepo.FindMember(roomID, userID)
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return nil, nil, err
+		}
+		if room.IsPrivate() {
+			return nil, nil, newChatError(ErrCodeNotFound, "Room not found")
+		}
+		return nil, nil, newChatError(ErrCodeForbidden, "Not a member of this room")
+	}
+	return room, member, nil
+}
+
+// requireWritable fails unless the user may post in the room: they must
+// be a member who is neither banned nor muted, and the room must not be
+// archived.
+func (s *ChatService) requireWritable(userID uint, roomID uint) error {
+	room, _, err := s.memberRoom(userID, roomID)
+	if err != nil {
+		return err
+	}
+	if room.IsArchived() {
+		return newChatError(ErrCodeForbidden, "This room is archived")
+	}
+	return s.checkSanctions(userID, roomID)
+}
+
+// UpdateRoom renames a room, and with a non-empty visibility changes who
+// can see and join it, and broadcasts room_updated to it. Only its
+// moderators and owner may rename it, and only the owner may change its
+// visibility.
+func (s *ChatService) UpdateRoom(user *models.User, roomID uint, name string, description string, visibility string) (*models.Room, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, newChatError(ErrCodeInvalidPayload, "Room name is required")
+	}
+	if visibility != "" && !models.ValidVisibility(visibility) {
+		return nil, newChatError(ErrCodeInvalidPayload, "Visibility must be public, restricted or private")
+	}
+	room, member, err := s.memberRoom(user.ID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.IsConversation() {
+		return nil, newChatError(ErrCodeForbidden, "Conversations cannot be renamed")
+	}
+	if !member.HasRole(models.RoleModerator) {
+		return nil, newChatError(ErrCodeForbidden, "Only moderators can rename this room")
+	}
+	if visibility != "" && visibility != room.Visibility && !member.HasRole(models.RoleOwner) {
+		return nil, newChatError(ErrCodeForbidden, "Only the owner can change the visibility of this room")
+	}
+	if room.IsArchived() {
+		return nil, newChatError(ErrCodeForbidden, "This room is archived")
+	}
+
+	room.Name = name
+	room.Description = description
+	if visibility != "" {
+		room.Visibility = visibility
+	}
+	if err := s.roomRepo.Update(room); err != nil {
+		return nil, err
+	}
+	return room, s.broadcastRoomUpdated(room)
+}
+
+// SetArchived archives or restores a room and broadcasts room_updated.
+// An archived room keeps its members and history but takes no new
+// messages, edits or reactions. Only the owner may archive a room.
+func (s *ChatService) SetArchived(user *models.User, roomID uint, archived bool) (*models.Room, error) {
+	room, member, err := s.memberRoom(user.ID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.IsConversation() {
+		return nil, newChatError(ErrCodeForbidden, "Only rooms can be archived")
+	}
+	if !member.HasRole(models.RoleOwner) {
+		return nil, newChatError(ErrCodeForbidden, "Only the owner can archive this room")
+	}
+	if room.IsArchived() == archived {
+		return room, nil
+	}
+
+	room.ArchivedAt = nil
+	if archived {
+		now := time.Now()
+		room.ArchivedAt = &now
+	}
+	if err := s.roomRepo.Update(room); err != nil {
+		return nil, err
+	}
+	return room, s.broadcastRoomUpdated(room)
+}
+
+func (s *ChatService) broadcastRoomUpdated(room *models.Room) error {
+	data, err := newEnvelope(TypeRoomUpdated, "", room.ID, room)
+	if err != nil {
+		return err
+	}
+	s.hub.BroadcastToRoom(room.ID, data)
+	return nil
+}
+
+// announceNewMembers broadcasts room_updated to a room and sends it to the
+// users just added to it, whose connections have not joined it yet.
+func (s *ChatService) announceNewMembers(room *models.Room, userIDs []uint) error {
+	data, err := newEnvelope(TypeRoomUpdated, "", room.ID, room)
+	if err != nil {
+		return err
+	}
+	s.hub.BroadcastToRoom(room.ID, data)
+	s.hub.SendToUsers(userIDs, data)
+	return nil
+}
+
+// DeleteRoom deletes a room with its history, tells its subscribers with
+// room_deleted and unsubscribes them. Only the owner may.
+func (s *ChatService) DeleteRoom(user *models.User, roomID uint) error {
+	room, member, err := s.memberRoom(user.ID, roomID)
+	if err != nil {
+		return err
+	}
+	if room.IsConversation() {
+		return newChatError(ErrCodeForbidden, "Conversations cannot be deleted")
+	}
+	if !member.HasRole(models.RoleOwner) {
+		return newChatError(ErrCodeForbidden, "Only the owner can delete this room")
+	}
+
+	if err := s.roomRepo.Delete(room.ID); err != nil {
+		return err
+	}
+	data, err := newEnvelope(TypeRoomDeleted, "", room.ID, nil)
+	if err != nil {
+		return err
+	}
+	s.hub.CloseRoom(room.ID, data)
+	return nil
+}
+
+// LeaveRoom takes the user out of a room or group conversation,
+// broadcasts member_left and unsubscribes the user's connections. Their
+// messages stay. The owner cannot leave: a room must always have one, so
+// they hand it over first, or delete it if nobody else is left.
+func (s *ChatService) LeaveRoom(user *models.User, roomID uint) error {
+	room, member, err := s.memberRoom(user.ID, roomID)
+	if err != nil {
+		return err
+	}
+	if room.IsDM() {
+		return newChatError(ErrCodeForbidden, "A 1:1 conversation cannot be left")
+	}
+	if member.Role == models.RoleOwner {
+		return newChatError(ErrCodeForbidden, "Transfer ownership before leaving this room, or delete it")
+	}
+
+	if err := s.roomRepo.RemoveUser(room.ID, user.ID); err != nil {
+		return err
+	}
+	data, err := newEnvelope(TypeMemberLeft, "", room.ID, MemberPayload{UserID: user.ID})
+	if err != nil {
+		return err
+	}
+	s.hub.RemoveFromRoom(room.ID, user.ID, data)
+	return nil
+}
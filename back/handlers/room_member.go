@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"quickstart/models"
+
+	"gorm.io/gorm"
+)
+
+// moderatedRoom loads a regular room for a member managing it and fails
+// unless they have at least role. Conversations have no roles.
+func (s *ChatService) moderatedRoom(user *models.User, roomID uint, role string) (*models.Room, *models.RoomMember, error) {
+	room, member, err := s.memberRoom(user.ID, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if room.IsConversation() {
+		return nil, nil, newChatError(ErrCodeForbidden, "Conversations have no roles")
+	}
+	if !member.HasRole(role) {
+		if role == models.RoleOwner {
+			return nil, nil, newChatError(ErrCodeForbidden, "Only the owner of this room can do that")
+		}
+		return nil, nil, newChatError(ErrCodeForbidden, "Only moderators of this room can do that")
+	}
+	return room, member, nil
+}
+
+// targetMember loads the membership of the user a moderator acts on.
+func (s *ChatService) targetMember(actor *models.RoomMember, userID uint) (*models.RoomMember, error) {
+	if userID == actor.UserID {
+		return nil, newChatError(ErrCodeInvalidPayload, "Cannot change your own membership")
+	}
+	member, err := s.roomRepo.FindMember(actor.RoomID, userID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Not a member of this room")
+		}
+		return nil, err
+	}
+	return member, nil
+}
+
+// Members returns the members of a room with their roles, the owner
+// first. Conversations only show their members to each other.
+func (s *ChatService) Members(user *models.User, roomID uint) ([]models.RoomMember, error) {
+	room, err := s.roomRepo.FindByID(roomID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Room not found")
+		}
+		return nil, err
+	}
+	if room.IsPrivate() && !hasMember(room, user.ID) {
+		return nil, newChatError(ErrCodeNotFound, "Room not found")
+	}
+	return s.roomRepo.FindMembers(roomID)
+}
+
+// SetRole makes a member a moderator or a plain member again and
+// broadcasts member_updated. Only the owner may; ownership itself moves
+// with TransferOwnership.
+func (s *ChatService) SetRole(user *models.User, roomID uint, userID uint, role string) (*models.RoomMember, error) {
+	if role != models.RoleModerator && role != models.RoleMember {
+		return nil, newChatError(ErrCodeInvalidPayload, "Role must be moderator or member")
+	}
+	_, owner, err := s.moderatedRoom(user, roomID, models.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	member, err := s.targetMember(owner, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member.Role == role {
+		return member, nil
+	}
+
+	if err := s.roomRepo.SetRole(roomID, userID, role); err != nil {
+		return nil, err
+	}
+	member.Role = role
+	return member, s.broadcastMembers(roomID, member)
+}
+
+// TransferOwnership hands the room over to another member. The previous
+// owner stays on as a moderator. Both changes are broadcast as
+// member_updated.
+func (s *ChatService) TransferOwnership(user *models.User, roomID uint, userID uint) ([]models.RoomMember, error) {
+	_, owner, err := s.moderatedRoom(user, roomID, models.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	member, err := s.targetMember(owner, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.roomRepo.TransferOwnership(roomID, owner.UserID, member.UserID); err != nil {
+		return nil, err
+	}
+	member.Role = models.RoleOwner
+	owner.Role = models.RoleModerator
+	if err := s.broadcastMembers(roomID, member, owner); err != nil {
+		return nil, err
+	}
+	return s.roomRepo.FindMembers(roomID)
+}
+
+// KickMember removes a member with a lower role than the user's from the
+// room, broadcasts member_kicked, unsubscribes the member's connections
+// and audits it with reason. Moderators can kick members; the owner can
+// kick anyone. Kicked members may join again.
+func (s *ChatService) KickMember(user *models.User, roomID uint, userID uint, reason string) error {
+	_, moderator, err := s.moderatedRoom(user, roomID, models.RoleModerator)
+	if err != nil {
+		return err
+	}
+	member, err := s.targetMember(moderator, userID)
+	if err != nil {
+		return err
+	}
+	if err := requireOutranks(moderator, member); err != nil {
+		return err
+	}
+
+	if err := s.roomRepo.RemoveUser(roomID, userID); err != nil {
+		return err
+	}
+	if err := s.auditModeration(roomID, user.ID, models.AuditMemberKicked, userID, reason, ""); err != nil {
+		return err
+	}
+	data, err := newEnvelope(TypeMemberKicked, "", roomID, MemberPayload{UserID: userID, By: user.ID, Reason: reason})
+	if err != nil {
+		return err
+	}
+	s.hub.RemoveFromRoom(roomID, userID, data)
+	return nil
+}
+
+// requireOutranks fails unless the moderator has a higher role than the
+// member they act on.
+func requireOutranks(moderator *models.RoomMember, member *models.RoomMember) error {
+	if member.HasRole(moderator.Role) {
+		return newChatError(ErrCodeForbidden, "Cannot act on a member with the same or a higher role")
+	}
+	return nil
+}
+
+func (s *ChatService) broadcastMembers(roomID uint, members ...*models.RoomMember) error {
+	for _, member := range members {
+		data, err := newEnvelope(TypeMemberUpdated, "", roomID, member)
+		if err != nil {
+			return err
+		}
+		s.hub.BroadcastToRoom(roomID, data)
+	}
+	return nil
+}
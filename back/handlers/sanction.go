@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"quickstart/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxSanctionDuration caps timed bans and mutes; longer bans should be
+// permanent.
+const maxSanctionDuration = 365 * 24 * time.Hour
+
+// bannedError maps models.ErrBanned to a chat error.
+func bannedError(err error) error {
+	if err == models.ErrBanned {
+		return newChatError(ErrCodeForbidden, "Banned from this room")
+	}
+	return err
+}
+
+// checkSanctions fails if the user is banned or muted in the room.
+func (s *ChatService) checkSanctions(userID uint, roomID uint) error {
+	sanctions, err := s.sanctionRepo.FindActive(roomID, userID)
+	if err != nil {
+		return err
+	}
+	for _, sanction := range sanctions {
+		if sanction.Kind == models.SanctionBan {
+			return newChatError(ErrCodeForbidden, "Banned from this room")
+		}
+	}
+	for _, sanction := range sanctions {
+		if sanction.Kind == models.SanctionMute {
+			if sanction.ExpiresAt == nil {
+				return newChatError(ErrCodeForbidden, "Muted in this room")
+			}
+			return newChatError(ErrCodeForbidden, "Muted in this room until "+sanction.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// auditModeration records a moderator's action against a user with their
+// reason.
+func (s *ChatService) auditModeration(roomID uint, moderatorID uint, action string, userID uint, reason string, detail string) error {
+	return s.auditRepo.Create(&models.AuditLog{
+		RoomID:       roomID,
+		ActorID:      moderatorID,
+		Action:       action,
+		TargetUserID: &userID,
+		Detail:       detail,
+		Reason:       reason,
+	})
+}
+
+// activeSanction returns the sanction of a kind in force against the user,
+// or nil.
+func (s *ChatService) activeSanction(roomID uint, userID uint, kind string) (*models.Sanction, error) {
+	sanctions, err := s.sanctionRepo.FindActive(roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sanctions {
+		if sanctions[i].Kind == kind {
+			return &sanctions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// sanction stores a ban or mute of userID by a moderator of the room, for
+// duration or for good if it is 0. Only members can be muted, and members
+// must rank below the moderator. It returns the new sanction and the
+// membership of the user, nil if they are not a member.
+func (s *ChatService) sanction(user *models.User, roomID uint, userID uint, kind string, reason string, duration time.Duration) (*models.Sanction, *models.RoomMember, error) {
+	if duration > maxSanctionDuration {
+		return nil, nil, newChatError(ErrCodeInvalidPayload, "Duration is too long, leave it out for a permanent ban")
+	}
+	_, moderator, err := s.moderatedRoom(user, roomID, models.RoleModerator)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, err := s.targetMember(moderator, userID)
+	if err != nil {
+		// Only members can be muted; anyone can be banned.
+		var ce *chatError
+		if kind != models.SanctionBan || !errors.As(err, &ce) || ce.code != ErrCodeNotFound {
+			return nil, nil, err
+		}
+		member = nil
+	}
+	if member != nil {
+		if err := requireOutranks(moderator, member); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	existing, err := s.activeSanction(roomID, userID, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing != nil {
+		return nil, nil, newChatError(ErrCodeInvalidPayload, "User is already "+sanctionedAs(kind)+" in this room")
+	}
+
+	sanction := &models.Sanction{RoomID: roomID, UserID: userID, Kind: kind, ModeratorID: user.ID, Reason: reason}
+	if duration > 0 {
+		expiresAt := time.Now().Add(duration)
+		sanction.ExpiresAt = &expiresAt
+	}
+	if err := s.sanctionRepo.Create(sanction); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, newChatError(ErrCodeNotFound, "User not found")
+		}
+		return nil, nil, err
+	}
+	return sanction, member, nil
+}
+
+func sanctionedAs(kind string) string {
+	if kind == models.SanctionBan {
+		return "banned"
+	}
+	return "muted"
+}
+
+// BanUser bans a user from a room for duration, or until lifted if it is
+// 0. A banned member is removed and their connections are unsubscribed
+// after a member_banned frame. Users can be banned before they join.
+func (s *ChatService) BanUser(user *models.User, roomID uint, userID uint, reason string, duration time.Duration) (*models.Sanction, error) {
+	ban, member, err := s.sanction(user, roomID, userID, models.SanctionBan, reason, duration)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.auditModeration(roomID, user.ID, models.AuditMemberBanned, userID, reason, fmt.Sprintf("sanction %d", ban.ID)); err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return ban, nil
+	}
+
+	data, err := newEnvelope(TypeMemberBanned, "", roomID, ban)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.RemoveFromRoom(roomID, userID, data)
+	return ban, nil
+}
+
+// MuteMember keeps a member from posting in a room for duration and
+// broadcasts member_muted.
+func (s *ChatService) MuteMember(user *models.User, roomID uint, userID uint, reason string, duration time.Duration) (*models.Sanction, error) {
+	if duration <= 0 {
+		return nil, newChatError(ErrCodeInvalidPayload, "A mute needs a duration")
+	}
+	mute, _, err := s.sanction(user, roomID, userID, models.SanctionMute, reason, duration)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.auditModeration(roomID, user.ID, models.AuditMemberMuted, userID, reason, fmt.Sprintf("sanction %d", mute.ID)); err != nil {
+		return nil, err
+	}
+
+	data, err := newEnvelope(TypeMemberMuted, "", roomID, mute)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.BroadcastToRoom(roomID, data)
+	return mute, nil
+}
+
+// LiftSanction lifts the ban or mute of a user before it expires. Lifting
+// a mute broadcasts member_unmuted; unbanned users have to join again.
+func (s *ChatService) LiftSanction(user *models.User, roomID uint, userID uint, kind string, reason string) error {
+	if _, _, err := s.moderatedRoom(user, roomID, models.RoleModerator); err != nil {
+		return err
+	}
+	sanction, err := s.activeSanction(roomID, userID, kind)
+	if err != nil {
+		return err
+	}
+	if sanction == nil {
+		return newChatError(ErrCodeNotFound, "User is not "+sanctionedAs(kind)+" in this room")
+	}
+
+	if err := s.sanctionRepo.Lift(sanction, user.ID); err != nil {
+		return err
+	}
+	action := models.AuditMemberUnbanned
+	if kind == models.SanctionMute {
+		action = models.AuditMemberUnmuted
+	}
+	if err := s.auditModeration(roomID, user.ID, action, userID, reason, fmt.Sprintf("sanction %d", sanction.ID)); err != nil {
+		return err
+	}
+	if kind != models.SanctionMute {
+		return nil
+	}
+
+	data, err := newEnvelope(TypeMemberUnmuted, "", roomID, MemberPayload{UserID: userID, By: user.ID, Reason: reason})
+	if err != nil {
+		return err
+	}
+	s.hub.BroadcastToRoom(roomID, data)
+	return nil
+}
+
+// ExpireSanctions marks the bans and mutes that ran out every interval as
+// lifted, and broadcasts member_unmuted for the mutes. It never returns.
+func (s *ChatService) ExpireSanctions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		sanctions, err := s.sanctionRepo.Expire(now)
+		if err != nil {
+			log.Println("Failed to expire sanctions:", err)
+			continue
+		}
+		for _, sanction := range sanctions {
+			if sanction.Kind != models.SanctionMute {
+				continue
+			}
+			data, err := newEnvelope(TypeMemberUnmuted, "", sanction.RoomID, MemberPayload{UserID: sanction.UserID})
+			if err != nil {
+				log.Println("Failed to notify expired mute:", err)
+				continue
+			}
+			s.hub.BroadcastToRoom(sanction.RoomID, data)
+		}
+	}
+}
+
+// Sanctions returns the bans or mutes in force in a room to its
+// moderators.
+func (s *ChatService) Sanctions(user *models.User, roomID uint, kind string) ([]models.Sanction, error) {
+	if _, _, err := s.moderatedRoom(user, roomID, models.RoleModerator); err != nil {
+		return nil, err
+	}
+	return s.sanctionRepo.FindActiveByRoom(roomID, kind)
+}
+
+type SanctionRequest struct {
+	UserID uint   `json:"user_id" binding:"required"`
+	Reason string `json:"reason" binding:"max=500"`
+	// Duration is in seconds, at most a year. Bans without one last until
+	// lifted; mutes need one.
+	Duration int `json:"duration" binding:"min=0,max=31536000"`
+}
+
+type SanctionHandler struct {
+	chat *ChatService
+}
+
+func NewSanctionHandler(chat *ChatService) *SanctionHandler {
+	return &SanctionHandler{chat: chat}
+}
+
+// BanUser godoc
+// @Summary Ban a user from a room
+// @Schemes
+// @Description Ban a user from a room, for duration seconds or until lifted. A banned member is removed; the room gets member_banned and their connections are unsubscribed. Banned users cannot join, accept invitations, use invite links or be approved until the ban ends. Moderators can ban members and non-members; the owner can ban moderators. The ban is recorded in the audit log with the reason.
+// @Tags moderation
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param ban body SanctionRequest true "User, reason and duration"
+// @Success 201 {object} models.Sanction
+// @Router /rooms/{roomId}/bans [post]
+func (h *SanctionHandler) BanUser(c *gin.Context) {
+	h.sanction(c, h.chat.BanUser)
+}
+
+// MuteMember godoc
+// @Summary Mute a room member
+// @Schemes
+// @Description Keep a member from posting, editing or reacting in a room for duration seconds. They can still read it. The room gets member_muted, and member_unmuted when the mute runs out or is lifted. The mute is recorded in the audit log with the reason.
+// @Tags moderation
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param roomId path int true "Room ID"
+// @Param mute body SanctionRequest true "User, reason and duration"
+// @Success 201 {object} models.Sanction
+// @Router /rooms/{roomId}/mutes [post]
+func (h *SanctionHandler) MuteMember(c *gin.Context) {
+	h.sanction(c, h.chat.MuteMember)
+}
+
+func (h *SanctionHandler) sanction(c *gin.Context, apply func(*models.User, uint, uint, string, time.Duration) (*models.Sanction, error)) {
+	roomID, err := strconv.ParseUint(c.Param("roomId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req SanctionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sanction, err := apply(currentUser(c), uint(roomID), req.UserID, req.Reason, time.Duration(req.Duration)*time.Second)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, sanction)
+}
+
+// GetBans godoc
+// @Summary Get the bans of a room
+// @Schemes
+// @Description Get the bans in force in a room, newest first. Only moderators can list bans.
+// @Tags moderation
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 200 {array} models.Sanction
+// @Router /rooms/{id}/bans [get]
+func (h *SanctionHandler) GetBans(c *gin.Context) {
+	h.list(c, models.SanctionBan)
+}
+
+// GetMutes godoc
+// @Summary Get the mutes of a room
+// @Schemes
+// @Description Get the mutes in force in a room, newest first. Only moderators can list mutes.
+// @Tags moderation
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Success 200 {array} models.Sanction
+// @Router /rooms/{id}/mutes [get]
+func (h *SanctionHandler) GetMutes(c *gin.Context) {
+	h.list(c, models.SanctionMute)
+}
+
+func (h *SanctionHandler) list(c *gin.Context, kind string) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	sanctions, err := h.chat.Sanctions(currentUser(c), uint(roomID), kind)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, sanctions)
+}
+
+// UnbanUser godoc
+// @Summary Lift a ban
+// @Schemes
+// @Description Lift the ban of a user before it expires. They can join the room again. Only moderators can lift bans; it is recorded in the audit log with the reason.
+// @Tags moderation
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param userId path int true "User ID"
+// @Param reason query string false "Why the ban is lifted"
+// @Success 204
+// @Router /rooms/{id}/bans/{userId} [delete]
+func (h *SanctionHandler) UnbanUser(c *gin.Context) {
+	h.lift(c, models.SanctionBan)
+}
+
+// UnmuteMember godoc
+// @Summary Lift a mute
+// @Schemes
+// @Description Lift the mute of a member before it expires and broadcast member_unmuted. Only moderators can lift mutes; it is recorded in the audit log with the reason.
+// @Tags moderation
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param userId path int true "User ID"
+// @Param reason query string false "Why the mute is lifted"
+// @Success 204
+// @Router /rooms/{id}/mutes/{userId} [delete]
+func (h *SanctionHandler) UnmuteMember(c *gin.Context) {
+	h.lift(c, models.SanctionMute)
+}
+
+func (h *SanctionHandler) lift(c *gin.Context, kind string) {
+	roomID, userID, ok := parseMemberParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.chat.LiftSanction(currentUser(c), roomID, userID, kind, c.Query("reason")); err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"quickstart/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+// PollResponse is the result of one long-poll request. Events are
+// envelopes as sent over /ws, oldest first; pass LastSeq back as after_seq
+// to continue where this response ended.
+type PollResponse struct {
+	Events  []json.RawMessage `json:"events" swaggertype:"array,object"`
+	LastSeq uint64            `json:"last_seq"`
+}
+
+// StreamHandler serves the SSE and long-poll fallbacks of /ws. Their
+// clients are registered with the same hub as WebSocket clients and get
+// the same frames, limited to one room per request.
+type StreamHandler struct {
+	hub    *Hub
+	chat   *ChatService
+	rooms  models.RoomRepository
+	config WebSocketConfig
+}
+
+// NewStreamHandler creates a stream handler. It uses the keepalive, write
+// and queue settings of config, so both transports behave alike.
+func NewStreamHandler(hub *Hub, chat *ChatService, roomRepo models.RoomRepository, config WebSocketConfig) *StreamHandler {
+	config.setDefaults()
+	return &StreamHandler{hub: hub, chat: chat, rooms: roomRepo, config: config}
+}
+
+// StreamRoom godoc
+// @Summary Stream room events
+// @Schemes
+// @Description Server-Sent Events fallback for /ws. The data of every event is an envelope as sent over /ws. Top-level chat_message events carry the message seq as their id, so a reconnecting EventSource resumes from Last-Event-ID (or resync_required when too much was missed). Since EventSource cannot set headers, the access token may be passed as the token query parameter. The stream ends after the event that removes the user from the room, such as member_kicked, member_banned or room_deleted.
+// @Tags rooms
+// @Produce text/event-stream
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param token query string false "Access token, for EventSource"
+// @Param Last-Event-ID header int false "Seq of the last chat_message received"
+// @Success 200 {string} string "Event stream"
+// @Router /rooms/{id}/stream [get]
+func (h *StreamHandler) StreamRoom(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	var lastSeq uint64
+	resume := c.GetHeader("Last-Event-ID")
+	if resume != "" {
+		if lastSeq, err = strconv.ParseUint(resume, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	client := newClient(h.hub, nil, currentUser(c), h.config.SendQueueSize)
+	client.roomScoped = true
+	room, err := h.subscribe(client, uint(roomID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	defer func() { h.hub.unregister <- client }()
+
+	if resume != "" {
+		frames, err := h.chat.Replay(room, lastSeq, maxResumeReplay)
+		if err != nil {
+			respondChatError(c, err)
+			return
+		}
+		for _, data := range frames {
+			client.enqueue(data)
+		}
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// Keeps nginx from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	rc := http.NewResponseController(c.Writer)
+	if err := h.writeSSE(rc, c.Writer, ": connected\n\n"); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(h.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-client.queue:
+			if !ok {
+				return
+			}
+			event := "data: " + string(data) + "\n\n"
+			if seq, isMessage := frameSeq(data); isMessage {
+				event = fmt.Sprintf("id: %d\n%s", seq, event)
+			}
+			if err := h.writeSSE(rc, c.Writer, event); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if err := h.writeSSE(rc, c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes and flushes one event within the write timeout.
+func (h *StreamHandler) writeSSE(rc *http.ResponseController, w gin.ResponseWriter, event string) error {
+	if err := rc.SetWriteDeadline(time.Now().Add(h.config.WriteWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := w.WriteString(event); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// PollRoom godoc
+// @Summary Long-poll room events
+// @Schemes
+// @Description Long-polling fallback for /ws. Returns the top-level chat messages after after_seq at once if there are any, otherwise waits up to timeout seconds for the next events of the room. Events are envelopes as sent over /ws. Without after_seq only new events are returned. Polling does not mark the user online.
+// @Tags rooms
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Room ID"
+// @Param after_seq query int false "last_seq of the previous response"
+// @Param timeout query int false "Seconds to wait (default 25, max 60)"
+// @Success 200 {object} PollResponse
+// @Router /rooms/{id}/poll [get]
+func (h *StreamHandler) PollRoom(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	timeout := defaultPollTimeout
+	if s := c.Query("timeout"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout"})
+			return
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+	}
+	// Validated before subscribing, which joins public rooms.
+	var afterSeq uint64
+	resumed := c.Query("after_seq") != ""
+	if resumed {
+		if afterSeq, err = strconv.ParseUint(c.Query("after_seq"), 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid after_seq"})
+			return
+		}
+	}
+
+	client := newClient(h.hub, nil, currentUser(c), h.config.SendQueueSize)
+	client.ephemeral = true
+	client.roomScoped = true
+	room, err := h.subscribe(client, uint(roomID))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	defer func() { h.hub.unregister <- client }()
+
+	if !resumed {
+		afterSeq = room.LastSeq
+	}
+
+	frames, err := h.chat.Replay(room, afterSeq, maxResumeReplay)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	if len(frames) == 0 {
+		frames = h.wait(c, client, timeout)
+	}
+
+	response := PollResponse{Events: make([]json.RawMessage, 0, len(frames)), LastSeq: afterSeq}
+	for _, data := range frames {
+		response.Events = append(response.Events, data)
+		if seq, _ := frameSeq(data); seq > response.LastSeq {
+			response.LastSeq = seq
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// wait returns the frames queued for the client once the first one
+// arrives, or nothing after timeout.
+func (h *StreamHandler) wait(c *gin.Context, client *Client, timeout time.Duration) [][]byte {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var frames [][]byte
+	select {
+	case data, ok := <-client.queue:
+		if !ok {
+			return nil
+		}
+		frames = append(frames, data)
+	case <-timer.C:
+		return nil
+	case <-c.Request.Context().Done():
+		return nil
+	}
+
+	for {
+		select {
+		case data, ok := <-client.queue:
+			if !ok {
+				return frames
+			}
+			frames = append(frames, data)
+		default:
+			return frames
+		}
+	}
+}
+
+// subscribe joins the user to the room like join_room does over /ws and
+// registers the client for its frames. The caller must unregister it.
+func (h *StreamHandler) subscribe(client *Client, roomID uint) (*models.Room, error) {
+	if err := h.chat.JoinRoom(client.userID, roomID); err != nil {
+		return nil, err
+	}
+	h.hub.register <- client
+	h.hub.Join(client, roomID)
+
+	// Read the room after subscribing so no message falls in between.
+	room, err := h.rooms.FindByID(roomID)
+	if err != nil {
+		h.hub.unregister <- client
+		if err == gorm.ErrRecordNotFound {
+			return nil, newChatError(ErrCodeNotFound, "Room not found")
+		}
+		return nil, err
+	}
+	return room, nil
+}
+
+// frameSeq returns the room seq a frame brings its reader up to, and
+// whether the frame is a top-level chat_message. Frames about thread
+// replies carry the seq of the reply within its thread and count as
+// neither.
+func frameSeq(data []byte) (uint64, bool) {
+	var frame struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Seq      uint64 `json:"seq"`
+			LastSeq  uint64 `json:"last_seq"`
+			ParentID uint   `json:"parent_id"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil || frame.Payload.ParentID != 0 {
+		return 0, false
+	}
+	return max(frame.Payload.Seq, frame.Payload.LastSeq), frame.Type == TypeChatMessage
+}
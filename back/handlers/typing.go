@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// typingThrottle is the minimum interval between two typing_start
+	// frames relayed for the same connection and room, so flapping
+	// start/stop clients cannot flood the room.
+	typingThrottle = 2 * time.Second
+	// typingTimeout clears an indicator that was not refreshed, so a client
+	// that stops sending never leaves a stale "is typing".
+	typingTimeout = 6 * time.Second
+)
+
+// TypingEventPayload identifies who started or stopped typing in room_id.
+type TypingEventPayload struct {
+	UserID uint `json:"user_id"`
+}
+
+type typingKey struct {
+	client *Client
+	roomID uint
+}
+
+// typingState is an active indicator. relayed is false while a throttled
+// start has not been announced yet; its stop is then not announced either.
+type typingState struct {
+	timer   *time.Timer
+	relayed bool
+}
+
+// typingTracker relays typing indicators with per-connection throttling
+// and server-side expiry.
+type typingTracker struct {
+	hub *Hub
+
+	mu        sync.Mutex
+	states    map[typingKey]*typingState
+	lastStart map[typingKey]time.Time
+}
+
+func newTypingTracker(hub *Hub) *typingTracker {
+	return &typingTracker{
+		hub:       hub,
+		states:    make(map[typingKey]*typingState),
+		lastStart: make(map[typingKey]time.Time),
+	}
+}
+
+// start marks the client as typing in the room, or extends the expiry of
+// an indicator that is already active.
+func (t *typingTracker) start(client *Client, roomID uint) {
+	key := typingKey{client: client, roomID: roomID}
+	now := time.Now()
+
+	t.mu.Lock()
+	state, active := t.states[key]
+	if active {
+		state.timer.Reset(typingTimeout)
+	} else {
+		state = &typingState{}
+		state.timer = time.AfterFunc(typingTimeout, func() { t.expire(key, state) })
+		t.states[key] = state
+	}
+	relay := !state.relayed && now.Sub(t.lastStart[key]) >= typingThrottle
+	if relay {
+		state.relayed = true
+		t.lastStart[key] = now
+	}
+	t.mu.Unlock()
+
+	if relay {
+		t.relay(TypeTypingStart, key)
+	}
+}
+
+// stop clears the client's indicator in the room, if any.
+func (t *typingTracker) stop(client *Client, roomID uint) {
+	key := typingKey{client: client, roomID: roomID}
+
+	t.mu.Lock()
+	state, active := t.states[key]
+	if active {
+		state.timer.Stop()
+		delete(t.states, key)
+	}
+	t.mu.Unlock()
+
+	if active && state.relayed {
+		t.relay(TypeTypingStop, key)
+	}
+}
+
+// expire is called by the timer of an indicator that was not refreshed.
+func (t *typingTracker) expire(key typingKey, state *typingState) {
+	t.mu.Lock()
+	current := t.states[key]
+	if current == state {
+		delete(t.states, key)
+	}
+	t.mu.Unlock()
+
+	if current == state && state.relayed {
+		t.relay(TypeTypingStop, key)
+	}
+}
+
+// clear stops every indicator of a client, optionally limited to one room
+// (roomID 0 means all rooms). Used on leave and disconnect.
+func (t *typingTracker) clear(client *Client, roomID uint) {
+	t.mu.Lock()
+	var stopped []typingKey
+	for key, state := range t.states {
+		if key.client == client && (roomID == 0 || key.roomID == roomID) {
+			state.timer.Stop()
+			delete(t.states, key)
+			if state.relayed {
+				stopped = append(stopped, key)
+			}
+		}
+	}
+	for key := range t.lastStart {
+		if key.client == client && (roomID == 0 || key.roomID == roomID) {
+			delete(t.lastStart, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range stopped {
+		t.relay(TypeTypingStop, key)
+	}
+}
+
+func (t *typingTracker) relay(frameType string, key typingKey) {
+	data, err := newEnvelope(frameType, "", key.roomID, TypingEventPayload{UserID: key.client.userID})
+	if err != nil {
+		log.Println("Failed to encode typing frame:", err)
+		return
+	}
+	t.hub.BroadcastToRoomExcept(key.roomID, data, key.client.userID)
+}
@@ -17,31 +17,6 @@ func NewUserHandler(userRepo models.UserRepository) *UserHandler {
     return &UserHandler{userRepo: userRepo}
 }
 
-// CreateUser godoc
-// @Summary Create a new user
-// @Schemes
-// @Description Create a new user
-// @Tags users
-// @Accept json
-// @Produce json
-// @Param user body models.User true "User object"
-// @Success 201 {object} models.User
-// @Router /users [post]
-func (h *UserHandler) CreateUser(c *gin.Context) {
-    var user models.User
-    if err := c.ShouldBindJSON(&user); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
-    }
-    
-    if err := h.userRepo.Create(&user); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-    
-    c.JSON(http.StatusCreated, user)
-}
-
 // GetUsers godoc
 // @Summary Get all users
 // @Schemes
@@ -49,6 +24,7 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 // @Tags users
 // @Accept json
 // @Produce json
+// @Security BearerAuth
 // @Success 200 {array} models.User
 // @Router /users [get]
 func (h *UserHandler) GetUsers(c *gin.Context) {
@@ -68,6 +44,7 @@ func (h *UserHandler) GetUsers(c *gin.Context) {
 // @Tags users
 // @Accept json
 // @Produce json
+// @Security BearerAuth
 // @Param id path int true "User ID"
 // @Success 200 {object} models.User
 // @Router /users/{id} [get]
@@ -1,61 +1,506 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"quickstart/models"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Cho phép tất cả origins
-	},
+// accessTokenProtocol is the Sec-WebSocket-Protocol marker browsers use to
+// pass the access token, since they cannot set an Authorization header:
+// new WebSocket(url, ["access_token", token]).
+const accessTokenProtocol = "access_token"
+
+const (
+	// maxResumeReplay is the most messages replayed by one resume frame.
+	// It stays well below the default send queue size so a replay cannot
+	// get the client disconnected as a slow consumer.
+	maxResumeReplay = 100
+	// maxResumeRooms bounds the rooms a single resume frame may list.
+	maxResumeRooms = 50
+)
+
+// WebSocketConfig holds the tunables of the /ws endpoint. Zero values are
+// replaced by the defaults below.
+type WebSocketConfig struct {
+	// AllowedOrigins lists the browser origins allowed to connect. "*"
+	// allows any origin. Requests without an Origin header (bots, CLIs)
+	// are always accepted since they are authenticated by token.
+	AllowedOrigins []string
+
+	// PingInterval is how often the server pings; it must be shorter than
+	// PongWait, the time after which a silent connection is dropped.
+	PingInterval time.Duration
+	PongWait     time.Duration
+	// WriteWait bounds every write, so a stalled peer cannot hold a writer.
+	WriteWait time.Duration
+	// MaxMessageSize is the largest inbound frame in bytes.
+	MaxMessageSize int64
+	// SendQueueSize is how many outbound frames may be pending per
+	// connection before it is considered too slow and disconnected.
+	SendQueueSize int
 }
 
-type WebSocketHandler struct{}
+func (cfg *WebSocketConfig) setDefaults() {
+	if cfg.PongWait <= 0 {
+		cfg.PongWait = 60 * time.Second
+	}
+	if cfg.PingInterval <= 0 || cfg.PingInterval >= cfg.PongWait {
+		cfg.PingInterval = cfg.PongWait * 9 / 10
+	}
+	if cfg.WriteWait <= 0 {
+		cfg.WriteWait = 10 * time.Second
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = 32 * 1024
+	}
+	if cfg.SendQueueSize <= 0 {
+		cfg.SendQueueSize = 256
+	}
+}
 
-func NewWebSocketHandler() *WebSocketHandler {
-	return &WebSocketHandler{}
+type WebSocketHandler struct {
+	hub      *Hub
+	tokens   *TokenManager
+	userRepo models.UserRepository
+	roomRepo models.RoomRepository
+	chat     *ChatService
+	upgrader websocket.Upgrader
+	config   WebSocketConfig
+	typing   *typingTracker
 }
 
+func NewWebSocketHandler(hub *Hub, tokens *TokenManager, userRepo models.UserRepository, roomRepo models.RoomRepository, chat *ChatService, config WebSocketConfig) *WebSocketHandler {
+	config.setDefaults()
+	wsh := &WebSocketHandler{
+		hub:      hub,
+		tokens:   tokens,
+		userRepo: userRepo,
+		roomRepo: roomRepo,
+		chat:     chat,
+		config:   config,
+		typing:   newTypingTracker(hub),
+	}
+	wsh.upgrader = websocket.Upgrader{
+		Subprotocols: []string{accessTokenProtocol},
+		CheckOrigin:  originChecker(config.AllowedOrigins),
+	}
+	return wsh
+}
+
+// originChecker builds an Upgrader.CheckOrigin func from an allowlist.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	origins := make(map[string]bool, len(allowed))
+	for _, origin := range allowed {
+		origins[strings.TrimRight(origin, "/")] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || origins["*"] || origins[origin]
+	}
+}
+
+// HandleWebSocket authenticates the request, upgrades it and serves the
+// chat protocol. The access token is read from the token query parameter
+// or from the Sec-WebSocket-Protocol header; room_id, when present, is
+// joined straight away.
 func (wsh *WebSocketHandler) HandleWebSocket(c *gin.Context) {
-	// Upgrade HTTP connection thành WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if !wsh.upgrader.CheckOrigin(c.Request) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+		return
+	}
+
+	userID, err := wsh.tokens.ParseAccessToken(handshakeToken(c.Request))
 	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
 		return
 	}
-	defer conn.Close()
 
-	log.Println("Client connected!")
+	var roomID uint64
+	if roomIDStr := c.Query("room_id"); roomIDStr != "" {
+		roomID, err = strconv.ParseUint(roomIDStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+			return
+		}
+	}
+
+	user, err := wsh.userRepo.FindByID(userID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	// Gửi hello message
-	err = conn.WriteMessage(websocket.TextMessage, []byte("Hello World! WebSocket server connected."))
+	conn, err := wsh.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Println("Write error:", err)
+		log.Println("WebSocket upgrade error:", err)
 		return
 	}
 
-	// Lắng nghe messages từ client
+	client := newClient(wsh.hub, conn, user, wsh.config.SendQueueSize)
+	wsh.hub.register <- client
+	defer func() {
+		wsh.typing.clear(client, 0)
+		// Unregistering closes the send queue; writePump then closes conn.
+		wsh.hub.unregister <- client
+	}()
+	go client.writePump(wsh.config)
+
+	log.Printf("User %d connected", client.userID)
+
+	conn.SetReadLimit(wsh.config.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsh.config.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsh.config.PongWait))
+	})
+
+	if roomID != 0 {
+		if err := wsh.joinRoom(client, uint(roomID)); err != nil {
+			wsh.sendError(client, "", err)
+		}
+	}
+
 	for {
-		messageType, message, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Read error:", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("Read error:", err)
+			}
 			break
 		}
+		// Any frame proves the peer is alive, not just pongs.
+		conn.SetReadDeadline(time.Now().Add(wsh.config.PongWait))
+		wsh.hub.Touch(client)
 
-		log.Printf("Received: %s", message)
+		env, err := decodeEnvelope(data)
+		if err == nil {
+			err = wsh.dispatch(client, env)
+		}
+		if err != nil {
+			var id string
+			if env != nil {
+				id = env.ID
+			}
+			wsh.sendError(client, id, err)
+		}
+	}
+
+	log.Printf("User %d disconnected", client.userID)
+}
+
+// handshakeToken extracts the access token from the token query parameter
+// or from a Sec-WebSocket-Protocol list of the form "access_token, <jwt>".
+func handshakeToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == accessTokenProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// dispatch routes a decoded frame to its registered handler.
+func (wsh *WebSocketHandler) dispatch(client *Client, env *Envelope) error {
+	handler, ok := frameHandlers[env.Type]
+	if !ok {
+		return newChatError(ErrCodeUnknownType, "Unknown frame type: "+env.Type)
+	}
+	if handler.requiresRoom && env.RoomID == 0 {
+		return newChatError(ErrCodeRoomRequired, "room_id is required for "+env.Type)
+	}
+	return handler.handle(wsh, client, env)
+}
+
+func (wsh *WebSocketHandler) handleJoinRoom(client *Client, env *Envelope) error {
+	if err := decodePayload(env, &struct{}{}); err != nil {
+		return err
+	}
+	if err := wsh.joinRoom(client, env.RoomID); err != nil {
+		return err
+	}
+	return wsh.sendAck(client, env, nil)
+}
 
-		// Echo message trở lại client
-		response := "Server received: " + string(message)
-		err = conn.WriteMessage(messageType, []byte(response))
+func (wsh *WebSocketHandler) handleLeaveRoom(client *Client, env *Envelope) error {
+	if err := decodePayload(env, &struct{}{}); err != nil {
+		return err
+	}
+	wsh.typing.clear(client, env.RoomID)
+	wsh.hub.Leave(client, env.RoomID)
+	return wsh.sendAck(client, env, nil)
+}
+
+// joinRoom subscribes the client to a room, adding the user as a member
+// first if needed.
+func (wsh *WebSocketHandler) joinRoom(client *Client, roomID uint) error {
+	if err := wsh.chat.JoinRoom(client.userID, roomID); err != nil {
+		return err
+	}
+	wsh.hub.Join(client, roomID)
+	return nil
+}
+
+// handleResume resubscribes a reconnecting client to its rooms and replays
+// the messages it missed. Rooms whose gap does not fit in what is left of
+// the replay budget get resync_required instead. The client is subscribed
+// before the replay is read, so a message sent meanwhile may arrive twice;
+// clients drop seqs they already have.
+func (wsh *WebSocketHandler) handleResume(client *Client, env *Envelope) error {
+	var payload ResumePayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if len(payload.Rooms) == 0 {
+		return newChatError(ErrCodeInvalidPayload, "rooms is required")
+	}
+	if len(payload.Rooms) > maxResumeRooms {
+		return newChatError(ErrCodeInvalidPayload, "Too many rooms to resume")
+	}
+
+	// Check every room first so a rejected resume has no effect.
+	rooms := make([]*models.Room, 0, len(payload.Rooms))
+	for roomID := range payload.Rooms {
+		room, err := wsh.roomRepo.FindByID(roomID)
 		if err != nil {
-			log.Println("Write error:", err)
-			break
+			if err == gorm.ErrRecordNotFound {
+				return newChatError(ErrCodeNotFound, "Room not found")
+			}
+			return err
+		}
+		isMember, err := wsh.roomRepo.IsMember(roomID, client.userID)
+		if err != nil {
+			return err
+		}
+		if !isMember {
+			return newChatError(ErrCodeForbidden, "Not a member of this room")
 		}
+		rooms = append(rooms, room)
 	}
 
-	log.Println("Client disconnected!")
-}
\ No newline at end of file
+	budget := maxResumeReplay
+	for _, room := range rooms {
+		wsh.hub.Join(client, room.ID)
+		frames, err := wsh.chat.Replay(room, payload.Rooms[room.ID], budget)
+		if err != nil {
+			return err
+		}
+		for _, data := range frames {
+			client.enqueue(data)
+		}
+		budget -= len(frames)
+	}
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleChatMessage(client *Client, env *Envelope) error {
+	var payload ChatMessagePayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if !wsh.hub.IsSubscribed(client, env.RoomID) {
+		return newChatError(ErrCodeForbidden, "Join the room before sending messages")
+	}
+
+	message, err := wsh.chat.SendMessage(client.user, env.RoomID, payload)
+	if err != nil {
+		return err
+	}
+	wsh.typing.stop(client, env.RoomID)
+	return wsh.sendAck(client, env, MessageAckPayload{
+		MessageID:   message.ID,
+		Seq:         message.Seq,
+		ClientMsgID: payload.ClientMsgID,
+		CreatedAt:   message.CreatedAt,
+	})
+}
+
+func (wsh *WebSocketHandler) handleEditMessage(client *Client, env *Envelope) error {
+	var payload EditMessagePayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return newChatError(ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	if _, err := wsh.chat.EditMessage(client.user, payload.MessageID, payload.Content); err != nil {
+		return err
+	}
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleDeleteMessage(client *Client, env *Envelope) error {
+	var payload DeleteMessagePayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return newChatError(ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	if _, err := wsh.chat.DeleteMessage(client.user, payload.MessageID); err != nil {
+		return err
+	}
+	return wsh.sendAck(client, env, nil)
+}
+
+// handleJoinThread subscribes the client to a thread it is viewing. Its
+// replies are otherwise only delivered to the thread's participants.
+func (wsh *WebSocketHandler) handleJoinThread(client *Client, env *Envelope) error {
+	var payload ThreadPayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return newChatError(ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	root, err := wsh.chat.OpenThread(client.user, payload.MessageID)
+	if err != nil {
+		return err
+	}
+	wsh.hub.JoinThread(client, root.RoomID, root.ID)
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleLeaveThread(client *Client, env *Envelope) error {
+	var payload ThreadPayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	wsh.hub.LeaveThread(client, payload.MessageID)
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleAddReaction(client *Client, env *Envelope) error {
+	var payload ReactionPayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return newChatError(ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	if _, err := wsh.chat.AddReaction(client.user, payload.MessageID, payload.Emoji); err != nil {
+		return err
+	}
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleRemoveReaction(client *Client, env *Envelope) error {
+	var payload ReactionPayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return newChatError(ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	if _, err := wsh.chat.RemoveReaction(client.user, payload.MessageID, payload.Emoji); err != nil {
+		return err
+	}
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleMarkRead(client *Client, env *Envelope) error {
+	var payload MarkReadPayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return newChatError(ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	if _, err := wsh.chat.MarkRead(client.user, env.RoomID, payload.MessageID); err != nil {
+		return err
+	}
+	return wsh.sendAck(client, env, nil)
+}
+
+func (wsh *WebSocketHandler) handleTypingStart(client *Client, env *Envelope) error {
+	if err := decodePayload(env, &struct{}{}); err != nil {
+		return err
+	}
+	if !wsh.hub.IsSubscribed(client, env.RoomID) {
+		return newChatError(ErrCodeForbidden, "Join the room before sending typing updates")
+	}
+	// Only members who may post are shown typing.
+	if err := wsh.chat.requireWritable(client.userID, env.RoomID); err != nil {
+		return err
+	}
+	wsh.typing.start(client, env.RoomID)
+	return nil
+}
+
+func (wsh *WebSocketHandler) handleTypingStop(client *Client, env *Envelope) error {
+	if err := decodePayload(env, &struct{}{}); err != nil {
+		return err
+	}
+	wsh.typing.stop(client, env.RoomID)
+	return nil
+}
+
+// handleClientAck accepts acknowledgements of server frames. Delivery is
+// not tracked yet, so they only need to be well formed.
+func (wsh *WebSocketHandler) handleClientAck(client *Client, env *Envelope) error {
+	return decodePayload(env, &struct{}{})
+}
+
+// handleClientError logs errors reported by clients about server frames.
+func (wsh *WebSocketHandler) handleClientError(client *Client, env *Envelope) error {
+	var payload ErrorPayload
+	if err := decodePayload(env, &payload); err != nil {
+		return err
+	}
+	log.Printf("User %d reported error on frame %q: %s: %s", client.userID, env.ID, payload.Code, payload.Message)
+	return nil
+}
+
+// sendAck confirms to the sender that env was processed. Frames without an
+// ID are only acknowledged when the ack carries a payload.
+func (wsh *WebSocketHandler) sendAck(client *Client, env *Envelope, payload interface{}) error {
+	if env.ID == "" && payload == nil {
+		return nil
+	}
+	data, err := newEnvelope(TypeAck, env.ID, env.RoomID, payload)
+	if err != nil {
+		return err
+	}
+	client.enqueue(data)
+	return nil
+}
+
+// sendError reports a rejected frame to the client. Errors that are not
+// chatErrors are logged and reported without details.
+func (wsh *WebSocketHandler) sendError(client *Client, id string, err error) {
+	payload := ErrorPayload{Code: ErrCodeInternal, Message: "Internal server error"}
+	var fe *chatError
+	if errors.As(err, &fe) {
+		payload = ErrorPayload{Code: fe.code, Message: fe.message}
+	} else {
+		log.Printf("Frame from user %d failed: %v", client.userID, err)
+	}
+
+	data, err := newEnvelope(TypeError, id, 0, payload)
+	if err != nil {
+		log.Println("Failed to encode error frame:", err)
+		return
+	}
+	client.enqueue(data)
+}
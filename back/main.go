@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
+	"fmt"
 	"log"
+	"os"
 	docs "quickstart/docs"
 	"quickstart/handlers"
 	"quickstart/models"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/glebarez/sqlite"
@@ -15,6 +21,11 @@ import (
 
 // @BasePath /api/v1
 
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description Type "Bearer" followed by a space and the access token.
+
 // Database instance
 var db *gorm.DB
 
@@ -24,7 +35,7 @@ func CORSMiddleware() gin.HandlerFunc {
         c.Header("Access-Control-Allow-Origin", "*")
         c.Header("Access-Control-Allow-Credentials", "true")
         c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-        c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+        c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
         if c.Request.Method == "OPTIONS" {
             c.AbortWithStatus(204)
@@ -35,6 +46,72 @@ func CORSMiddleware() gin.HandlerFunc {
     }
 }
 
+// getEnv returns the environment variable or fallback when it is unset.
+func getEnv(key, fallback string) string {
+    if value, ok := os.LookupEnv(key); ok && value != "" {
+        return value
+    }
+    return fallback
+}
+
+// getEnvDuration parses a duration such as "15m" from the environment.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value, err := time.ParseDuration(getEnv(key, fallback.String()))
+    if err != nil {
+        log.Fatalf("Invalid %s: %v", key, err)
+    }
+    return value
+}
+
+// getEnvPositiveDuration is getEnvDuration for settings that must be
+// positive, such as ticker intervals; other values fall back with a
+// warning.
+func getEnvPositiveDuration(key string, fallback time.Duration) time.Duration {
+    value := getEnvDuration(key, fallback)
+    if value <= 0 {
+        log.Printf("%s must be positive, using %s", key, fallback)
+        return fallback
+    }
+    return value
+}
+
+// getEnvInt parses an integer from the environment.
+func getEnvInt(key string, fallback int) int {
+    value, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+    if err != nil {
+        log.Fatalf("Invalid %s: %v", key, err)
+    }
+    return value
+}
+
+// newBroker connects to the Redis backplane at REDIS_URL so several
+// instances can share rooms, or keeps everything in process when unset.
+func newBroker() handlers.Broker {
+    url := os.Getenv("REDIS_URL")
+    if url == "" {
+        return handlers.NewMemoryBroker()
+    }
+    broker, err := handlers.NewRedisBroker(url, getEnv("REDIS_CHANNEL_PREFIX", "a01:"))
+    if err != nil {
+        log.Fatal("Failed to connect to Redis:", err)
+    }
+    return broker
+}
+
+// jwtSecret reads JWT_SECRET, falling back to a random per-process secret
+// so development works out of the box.
+func jwtSecret() []byte {
+    if secret := os.Getenv("JWT_SECRET"); secret != "" {
+        return []byte(secret)
+    }
+    log.Println("JWT_SECRET is not set; using a random secret, tokens will not survive restarts")
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        log.Fatal("Failed to generate JWT secret:", err)
+    }
+    return secret
+}
+
 func main() {
   // Initialize Database
   var err error
@@ -43,18 +120,79 @@ func main() {
     log.Fatal("Failed to connect to database:", err)
   }
 
+  if err := models.DedupeUserNames(db); err != nil {
+    log.Fatal("Failed to dedupe user names:", err)
+  }
+  if err := models.SetupRoomMembers(db); err != nil {
+    log.Fatal("Failed to set up room members:", err)
+  }
+
   // Auto Migrate the schema
-  db.AutoMigrate(&models.User{}, &models.Room{})
+  db.AutoMigrate(&models.User{}, &models.Room{}, &models.RoomMember{}, &models.Message{}, &models.RefreshToken{}, &models.ReadState{}, &models.MessageEdit{}, &models.Reaction{}, &models.Mention{}, &models.Invitation{}, &models.InviteLink{}, &models.AuditLog{}, &models.JoinRequest{}, &models.Sanction{})
+  if err := models.BackfillMessageSeq(db); err != nil {
+    log.Fatal("Failed to backfill message sequence numbers:", err)
+  }
+  if err := models.BackfillRoomOwners(db); err != nil {
+    log.Fatal("Failed to backfill room owners:", err)
+  }
 
   // Initialize repositories
   userRepo := models.NewUserRepository(db)
   roomRepo := models.NewRoomRepository(db)
+  messageRepo := models.NewMessageRepository(db)
+  refreshRepo := models.NewRefreshTokenRepository(db)
+  readRepo := models.NewReadStateRepository(db)
+  reactionRepo := models.NewReactionRepository(db)
+  mentionRepo := models.NewMentionRepository(db)
+  inviteRepo := models.NewInvitationRepository(db)
+  auditRepo := models.NewAuditLogRepository(db)
+  joinRepo := models.NewJoinRequestRepository(db)
+  sanctionRepo := models.NewSanctionRepository(db)
+
+  // "password-setup <name>" issues a setup token for an administrator to
+  // hand to the account owner, instead of starting the server.
+  if len(os.Args) == 3 && os.Args[1] == "password-setup" {
+    token, err := handlers.IssuePasswordSetupToken(userRepo, os.Args[2], getEnvDuration("PASSWORD_SETUP_TTL", 24*time.Hour))
+    if err != nil {
+      log.Fatal("Failed to issue password setup token:", err)
+    }
+    fmt.Println(token)
+    return
+  }
+
+  tokenManager := handlers.NewTokenManager(
+    jwtSecret(),
+    getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+    getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+  )
+
+  // Initialize the realtime hub
+  hub := handlers.NewHub(getEnvDuration("PRESENCE_IDLE_TIMEOUT", 5*time.Minute), newBroker())
+  go hub.Run()
+  chatService := handlers.NewChatService(hub, roomRepo, messageRepo, readRepo, reactionRepo, mentionRepo, inviteRepo, auditRepo, joinRepo, sanctionRepo)
 
   // Initialize handlers
   userHandler := handlers.NewUserHandler(userRepo)
-  roomHandler := handlers.NewRoomHandler(roomRepo)
-  authHandler := handlers.NewAuthHandler(userRepo)
-  wsHandler := handlers.NewWebSocketHandler()
+  roomHandler := handlers.NewRoomHandler(roomRepo, readRepo, chatService)
+  messageHandler := handlers.NewMessageHandler(messageRepo, roomRepo, chatService)
+  invitationHandler := handlers.NewInvitationHandler(chatService)
+  joinRequestHandler := handlers.NewJoinRequestHandler(chatService, getEnvPositiveDuration("JOIN_REQUEST_TTL", 7*24*time.Hour))
+  sanctionHandler := handlers.NewSanctionHandler(chatService)
+  go chatService.ExpireJoinRequests(getEnvPositiveDuration("JOIN_REQUEST_SWEEP_INTERVAL", time.Minute))
+  go chatService.ExpireSanctions(getEnvPositiveDuration("SANCTION_SWEEP_INTERVAL", 5*time.Second))
+  authHandler := handlers.NewAuthHandler(userRepo, refreshRepo, tokenManager)
+  wsConfig := handlers.WebSocketConfig{
+    AllowedOrigins: strings.Split(getEnv("ALLOWED_ORIGINS", "http://localhost:5173"), ","),
+    PingInterval:   getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+    PongWait:       getEnvDuration("WS_PONG_WAIT", 60*time.Second),
+    WriteWait:      getEnvDuration("WS_WRITE_WAIT", 10*time.Second),
+    MaxMessageSize: int64(getEnvInt("WS_MAX_MESSAGE_SIZE", 32*1024)),
+    SendQueueSize:  getEnvInt("WS_SEND_QUEUE_SIZE", 256),
+  }
+  wsHandler := handlers.NewWebSocketHandler(hub, tokenManager, userRepo, roomRepo, chatService, wsConfig)
+  go wsHandler.PublishPresence()
+  presenceHandler := handlers.NewPresenceHandler(hub, roomRepo)
+  streamHandler := handlers.NewStreamHandler(hub, chatService, roomRepo, wsConfig)
 
   router := gin.Default()
   
@@ -68,29 +206,109 @@ func main() {
       // Auth routes
       auth := v1.Group("/auth")
       {
+         auth.POST("/register", authHandler.Register)
          auth.POST("/login", authHandler.Login)
+         auth.POST("/password/setup", authHandler.SetupPassword)
+         auth.POST("/refresh", authHandler.Refresh)
+         auth.POST("/logout", authHandler.Logout)
       }
 
+      // SSE fallback of /ws; also takes the token as a query parameter
+      v1.GET("/rooms/:id/stream", handlers.StreamAuthMiddleware(tokenManager, userRepo), streamHandler.StreamRoom)
+
+      // Everything below requires an access token
+      protected := v1.Group("")
+      protected.Use(handlers.AuthMiddleware(tokenManager, userRepo))
+
       // User routes
-      users := v1.Group("/users")
+      users := protected.Group("/users")
       {
-         users.POST("", userHandler.CreateUser)
          users.GET("", userHandler.GetUsers)
          users.GET("/:id", userHandler.GetUser)
       }
       
       // Room routes
-      rooms := v1.Group("/rooms")
+      rooms := protected.Group("/rooms")
       {
          rooms.POST("", roomHandler.CreateRoom)
          rooms.GET("", roomHandler.GetRooms)
          rooms.GET("/:id", roomHandler.GetRoom)
+         rooms.PUT("/:id", roomHandler.UpdateRoom)
+         rooms.DELETE("/:id", roomHandler.DeleteRoom)
+         rooms.POST("/:roomId/archive", roomHandler.ArchiveRoom)
+         rooms.POST("/:roomId/unarchive", roomHandler.UnarchiveRoom)
+         rooms.POST("/:roomId/leave", roomHandler.LeaveRoom)
+         rooms.POST("/:roomId/transfer", roomHandler.TransferOwnership)
+         rooms.GET("/:id/members", roomHandler.GetRoomMembers)
+         rooms.PUT("/:id/members/:userId", roomHandler.SetMemberRole)
+         rooms.DELETE("/:id/members/:userId", roomHandler.KickMember)
+         rooms.POST("/:roomId/invitations", invitationHandler.InviteUser)
+         rooms.POST("/:roomId/invite-links", invitationHandler.CreateInviteLink)
+         rooms.GET("/:id/invite-links", invitationHandler.GetInviteLinks)
+         rooms.DELETE("/:id/invite-links/:linkId", invitationHandler.RevokeInviteLink)
+         rooms.GET("/:id/audit-log", invitationHandler.GetAuditLog)
+         rooms.POST("/:roomId/join-requests", joinRequestHandler.RequestToJoin)
+         rooms.GET("/:id/join-requests", joinRequestHandler.GetJoinRequests)
+         rooms.POST("/:roomId/join-requests/:requestId/approve", joinRequestHandler.ApproveJoinRequest)
+         rooms.POST("/:roomId/join-requests/:requestId/reject", joinRequestHandler.RejectJoinRequest)
+         rooms.POST("/:roomId/bans", sanctionHandler.BanUser)
+         rooms.GET("/:id/bans", sanctionHandler.GetBans)
+         rooms.DELETE("/:id/bans/:userId", sanctionHandler.UnbanUser)
+         rooms.POST("/:roomId/mutes", sanctionHandler.MuteMember)
+         rooms.GET("/:id/mutes", sanctionHandler.GetMutes)
+         rooms.DELETE("/:id/mutes/:userId", sanctionHandler.UnmuteMember)
          rooms.POST("/:roomId/join/:userId", roomHandler.JoinRoom)
+         rooms.GET("/:id/messages", messageHandler.GetRoomMessages)
+         rooms.GET("/:id/presence", presenceHandler.GetRoomPresence)
+         rooms.POST("/:roomId/read", messageHandler.MarkRoomRead)
+         rooms.POST("/:roomId/messages", messageHandler.SendRoomMessage)
+         rooms.GET("/:id/poll", streamHandler.PollRoom)
+      }
+
+      // Direct message routes
+      dms := protected.Group("/dms")
+      {
+         dms.POST("", roomHandler.OpenDM)
+         dms.GET("", roomHandler.GetDMs)
+         dms.POST("/groups", roomHandler.CreateGroupDM)
+         dms.POST("/:roomId/participants", roomHandler.AddParticipants)
+         dms.POST("/:roomId/promote", roomHandler.PromoteGroup)
+      }
+
+      // Current user routes
+      me := protected.Group("/me")
+      {
+         me.GET("/mentions", messageHandler.GetMyMentions)
+         me.GET("/invitations", invitationHandler.GetMyInvitations)
+      }
+
+      // Invitation routes
+      invitations := protected.Group("/invitations")
+      {
+         invitations.POST("/:id/accept", invitationHandler.AcceptInvitation)
+         invitations.POST("/:id/decline", invitationHandler.DeclineInvitation)
+         invitations.DELETE("/:id", invitationHandler.RevokeInvitation)
+      }
+      protected.POST("/invite-links/:code/join", invitationHandler.RedeemInviteLink)
+
+      // Message routes
+      messages := protected.Group("/messages")
+      {
+         messages.PATCH("/:id", messageHandler.EditMessage)
+         messages.DELETE("/:id", messageHandler.DeleteMessage)
+         messages.GET("/:id/edits", messageHandler.GetMessageEdits)
+         messages.GET("/:id/replies", messageHandler.GetMessageReplies)
+         messages.POST("/:id/reactions", messageHandler.AddReaction)
+         messages.DELETE("/:id/reactions/:emoji", messageHandler.RemoveReaction)
       }
   }
 
   // WebSocket endpoint
   router.GET("/ws", wsHandler.HandleWebSocket)
+  // JSON Schema of the /ws envelope protocol, for generating clients
+  router.GET("/ws/schema", func(c *gin.Context) {
+    c.Data(200, "application/schema+json", docs.WebSocketSchema)
+  })
 
   router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
 
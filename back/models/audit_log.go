@@ -0,0 +1,74 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// Audited room actions.
+const (
+    AuditInvitationCreated   = "invitation.created"
+    AuditInvitationAccepted  = "invitation.accepted"
+    AuditInvitationDeclined  = "invitation.declined"
+    AuditInvitationRevoked   = "invitation.revoked"
+    AuditInviteLinkCreated   = "invite_link.created"
+    AuditInviteLinkRevoked   = "invite_link.revoked"
+    AuditInviteLinkUsed      = "invite_link.used"
+    AuditJoinRequestApproved = "join_request.approved"
+    AuditJoinRequestRejected = "join_request.rejected"
+    AuditMemberKicked        = "member.kicked"
+    AuditMemberBanned        = "member.banned"
+    AuditMemberUnbanned      = "member.unbanned"
+    AuditMemberMuted         = "member.muted"
+    AuditMemberUnmuted       = "member.unmuted"
+)
+
+// AuditLog records who did what in a room. TargetUserID names the user
+// the action was about, if any, Detail holds action specific context
+// such as an invitation or invite link ID, and Reason is the moderator's
+// explanation for kicks, bans and mutes.
+type AuditLog struct {
+    ID           uint      `json:"id" gorm:"primaryKey"`
+    RoomID       uint      `json:"room_id" gorm:"not null;index"`
+    ActorID      uint      `json:"actor_id" gorm:"not null"`
+    Actor        *User     `json:"actor,omitempty"`
+    Action       string    `json:"action" gorm:"not null"`
+    TargetUserID *uint     `json:"target_user_id,omitempty"`
+    Detail       string    `json:"detail,omitempty"`
+    Reason       string    `json:"reason,omitempty"`
+    CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuditLogRepository interface
+type AuditLogRepository interface {
+    Create(entry *AuditLog) error
+    FindByRoom(roomID uint, query MessageQuery) ([]AuditLog, error)
+}
+
+// auditLogRepository implementation
+type auditLogRepository struct {
+    db *gorm.DB
+}
+
+// NewAuditLogRepository creates new audit log repository
+func NewAuditLogRepository(db *gorm.DB) AuditLogRepository {
+    return &auditLogRepository{db: db}
+}
+
+func (r *auditLogRepository) Create(entry *AuditLog) error {
+    return r.db.Create(entry).Error
+}
+
+// FindByRoom returns the audit log of a room, newest first, with the
+// users who acted. Before is an entry ID cursor; After is not supported.
+func (r *auditLogRepository) FindByRoom(roomID uint, query MessageQuery) ([]AuditLog, error) {
+    tx := r.db.Preload("Actor").Where("room_id = ?", roomID)
+    if query.Before != 0 {
+        tx = tx.Where("id < ?", query.Before)
+    }
+
+    var entries []AuditLog
+    err := tx.Order("id DESC").Limit(query.Limit).Find(&entries).Error
+    return entries, err
+}
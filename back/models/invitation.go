@@ -0,0 +1,245 @@
+package models
+
+import (
+    "errors"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Invitation statuses. Only pending invitations can be answered or
+// revoked.
+const (
+    InvitationPending  = "pending"
+    InvitationAccepted = "accepted"
+    InvitationDeclined = "declined"
+    InvitationRevoked  = "revoked"
+)
+
+// ErrInvitationClosed is returned when answering or revoking an
+// invitation that is no longer pending.
+var ErrInvitationClosed = errors.New("invitation is no longer pending")
+
+// ErrInviteLinkInvalid is returned when redeeming an invite link that was
+// revoked, has expired or has no uses left.
+var ErrInviteLinkInvalid = errors.New("invite link is no longer valid")
+
+// Invitation asks a user to join a room. The invitee becomes a member
+// only once they accept it.
+type Invitation struct {
+    ID          uint       `json:"id" gorm:"primaryKey"`
+    RoomID      uint       `json:"room_id" gorm:"not null;index"`
+    Room        *Room      `json:"room,omitempty"`
+    InviterID   uint       `json:"inviter_id" gorm:"not null"`
+    Inviter     *User      `json:"inviter,omitempty"`
+    InviteeID   uint       `json:"invitee_id" gorm:"not null;index"`
+    Status      string     `json:"status" gorm:"not null;default:pending"`
+    CreatedAt   time.Time  `json:"created_at"`
+    RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+// InviteLink is a shareable code that lets anyone holding it join a room.
+// MaxUses of 0 means unlimited, and a nil ExpiresAt never expires.
+type InviteLink struct {
+    ID        uint       `json:"id" gorm:"primaryKey"`
+    RoomID    uint       `json:"room_id" gorm:"not null;index"`
+    Code      string     `json:"code" gorm:"not null;uniqueIndex"`
+    CreatorID uint       `json:"creator_id" gorm:"not null"`
+    MaxUses   int        `json:"max_uses" gorm:"not null;default:0"`
+    Uses      int        `json:"uses" gorm:"not null;default:0"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
+    RevokedAt *time.Time `json:"revoked_at,omitempty"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+// Usable reports whether the link can still be redeemed at now.
+func (l *InviteLink) Usable(now time.Time) bool {
+    if l.RevokedAt != nil {
+        return false
+    }
+    if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+        return false
+    }
+    return l.MaxUses == 0 || l.Uses < l.MaxUses
+}
+
+// InvitationRepository interface
+type InvitationRepository interface {
+    Create(invitation *Invitation) error
+    FindByID(id uint) (*Invitation, error)
+    FindPending(roomID uint, inviteeID uint) (*Invitation, error)
+    FindPendingByUser(userID uint) ([]Invitation, error)
+    Accept(invitation *Invitation) error
+    Close(invitation *Invitation, status string) error
+    CreateLink(link *InviteLink) error
+    FindLink(roomID uint, id uint) (*InviteLink, error)
+    FindLinks(roomID uint) ([]InviteLink, error)
+    RevokeLink(link *InviteLink) error
+    RedeemLink(code string, userID uint) (*InviteLink, bool, error)
+}
+
+// invitationRepository implementation
+type invitationRepository struct {
+    db *gorm.DB
+}
+
+// NewInvitationRepository creates new invitation repository
+func NewInvitationRepository(db *gorm.DB) InvitationRepository {
+    return &invitationRepository{db: db}
+}
+
+// Create stores the invitation. It fails with gorm.ErrRecordNotFound if
+// the invitee does not exist.
+func (r *invitationRepository) Create(invitation *Invitation) error {
+    var user User
+    if err := r.db.Select("id").First(&user, invitation.InviteeID).Error; err != nil {
+        return err
+    }
+    return r.db.Create(invitation).Error
+}
+
+func (r *invitationRepository) FindByID(id uint) (*Invitation, error) {
+    var invitation Invitation
+    err := r.db.Preload("Room").Preload("Inviter").First(&invitation, id).Error
+    return &invitation, err
+}
+
+// FindPending returns the pending invitation of a user to a room.
+func (r *invitationRepository) FindPending(roomID uint, inviteeID uint) (*Invitation, error) {
+    var invitation Invitation
+    err := r.db.Where("room_id = ? AND invitee_id = ? AND status = ?", roomID, inviteeID, InvitationPending).
+        First(&invitation).Error
+    return &invitation, err
+}
+
+// FindPendingByUser returns the invitations a user has yet to answer,
+// newest first, with their rooms and inviters.
+func (r *invitationRepository) FindPendingByUser(userID uint) ([]Invitation, error) {
+    var invitations []Invitation
+    err := r.db.Preload("Room").Preload("Inviter").
+        Where("invitee_id = ? AND status = ?", userID, InvitationPending).
+        Order("id DESC").
+        Find(&invitations).Error
+    return invitations, err
+}
+
+// Accept marks the invitation accepted and makes the invitee a member of
+// the room, atomically. It fails with ErrInvitationClosed unless the
+// invitation is pending, and with ErrBanned if the invitee is banned from
+// the room.
+func (r *invitationRepository) Accept(invitation *Invitation) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        if err := checkNotBanned(tx, invitation.RoomID, invitation.InviteeID); err != nil {
+            return err
+        }
+        if err := (&invitationRepository{db: tx}).Close(invitation, InvitationAccepted); err != nil {
+            return err
+        }
+        member := RoomMember{RoomID: invitation.RoomID, UserID: invitation.InviteeID}
+        return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+    })
+}
+
+// Close moves a pending invitation to status. It fails with
+// ErrInvitationClosed unless the invitation is pending.
+func (r *invitationRepository) Close(invitation *Invitation, status string) error {
+    now := time.Now()
+    result := r.db.Model(&Invitation{}).
+        Where("id = ? AND status = ?", invitation.ID, InvitationPending).
+        Updates(map[string]interface{}{"status": status, "responded_at": now})
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrInvitationClosed
+    }
+    invitation.Status = status
+    invitation.RespondedAt = &now
+    return nil
+}
+
+func (r *invitationRepository) CreateLink(link *InviteLink) error {
+    return r.db.Create(link).Error
+}
+
+func (r *invitationRepository) FindLink(roomID uint, id uint) (*InviteLink, error) {
+    var link InviteLink
+    err := r.db.Where("room_id = ?", roomID).First(&link, id).Error
+    return &link, err
+}
+
+// FindLinks returns the invite links of a room, newest first, including
+// revoked and used up ones.
+func (r *invitationRepository) FindLinks(roomID uint) ([]InviteLink, error) {
+    var links []InviteLink
+    err := r.db.Where("room_id = ?", roomID).Order("id DESC").Find(&links).Error
+    return links, err
+}
+
+// RevokeLink stops the link from being redeemed. Revoking it again keeps
+// the original revocation time.
+func (r *invitationRepository) RevokeLink(link *InviteLink) error {
+    if link.RevokedAt != nil {
+        return nil
+    }
+    now := time.Now()
+    if err := r.db.Model(link).Update("revoked_at", now).Error; err != nil {
+        return err
+    }
+    link.RevokedAt = &now
+    return nil
+}
+
+// RedeemLink makes the user a member of the link's room and uses up one
+// use of it. The bool reports whether the user joined; members redeeming
+// the link again do not use it up. It fails with gorm.ErrRecordNotFound
+// for unknown codes and ErrInviteLinkInvalid for links that cannot be
+// redeemed any more, including links to archived rooms. Users banned
+// from the room get ErrBanned.
+func (r *invitationRepository) RedeemLink(code string, userID uint) (*InviteLink, bool, error) {
+    var link InviteLink
+    joined := false
+    err := r.db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("code = ?", code).First(&link).Error; err != nil {
+            return err
+        }
+        if !link.Usable(time.Now()) {
+            return ErrInviteLinkInvalid
+        }
+        var room Room
+        if err := tx.Select("id", "archived_at").First(&room, link.RoomID).Error; err != nil {
+            return err
+        }
+        if room.IsArchived() {
+            return ErrInviteLinkInvalid
+        }
+
+        var count int64
+        if err := tx.Model(&RoomMember{}).Where("room_id = ? AND user_id = ?", link.RoomID, userID).Count(&count).Error; err != nil {
+            return err
+        }
+        if count > 0 {
+            return nil
+        }
+        if err := checkNotBanned(tx, link.RoomID, userID); err != nil {
+            return err
+        }
+
+        // Guard the use count in the update itself so concurrent
+        // redemptions cannot exceed MaxUses.
+        result := tx.Model(&InviteLink{}).
+            Where("id = ? AND (max_uses = 0 OR uses < max_uses)", link.ID).
+            Update("uses", gorm.Expr("uses + 1"))
+        if result.Error != nil {
+            return result.Error
+        }
+        if result.RowsAffected == 0 {
+            return ErrInviteLinkInvalid
+        }
+        link.Uses++
+        joined = true
+        return tx.Create(&RoomMember{RoomID: link.RoomID, UserID: userID}).Error
+    })
+    return &link, joined, err
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+    "errors"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Join request statuses. Only pending requests can be reviewed.
+const (
+    JoinRequestPending  = "pending"
+    JoinRequestApproved = "approved"
+    JoinRequestRejected = "rejected"
+    JoinRequestExpired  = "expired"
+)
+
+// ErrJoinRequestClosed is returned when reviewing a join request that is
+// no longer pending or has expired.
+var ErrJoinRequestClosed = errors.New("join request is no longer pending")
+
+// JoinRequest asks the moderators of a restricted room to let a user in.
+// A pending request past ExpiresAt counts as expired even before it is
+// marked so.
+type JoinRequest struct {
+    ID         uint       `json:"id" gorm:"primaryKey"`
+    RoomID     uint       `json:"room_id" gorm:"not null;index"`
+    UserID     uint       `json:"user_id" gorm:"not null;index"`
+    User       *User      `json:"user,omitempty"`
+    Note       string     `json:"note,omitempty"`
+    Status     string     `json:"status" gorm:"not null;default:pending;index"`
+    ReviewerID *uint      `json:"reviewer_id,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+    ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+}
+
+// JoinRequestRepository interface
+type JoinRequestRepository interface {
+    Create(request *JoinRequest) error
+    FindByID(roomID uint, id uint) (*JoinRequest, error)
+    FindPending(roomID uint, userID uint) (*JoinRequest, error)
+    FindPendingByRoom(roomID uint) ([]JoinRequest, error)
+    Approve(request *JoinRequest, reviewerID uint) error
+    Reject(request *JoinRequest, reviewerID uint) error
+    Expire(now time.Time) ([]JoinRequest, error)
+}
+
+// joinRequestRepository implementation
+type joinRequestRepository struct {
+    db *gorm.DB
+}
+
+// NewJoinRequestRepository creates new join request repository
+func NewJoinRequestRepository(db *gorm.DB) JoinRequestRepository {
+    return &joinRequestRepository{db: db}
+}
+
+func (r *joinRequestRepository) Create(request *JoinRequest) error {
+    return r.db.Create(request).Error
+}
+
+func (r *joinRequestRepository) FindByID(roomID uint, id uint) (*JoinRequest, error) {
+    var request JoinRequest
+    err := r.db.Preload("User").Where("room_id = ?", roomID).First(&request, id).Error
+    return &request, err
+}
+
+// FindPending returns the live pending join request of a user to a room.
+func (r *joinRequestRepository) FindPending(roomID uint, userID uint) (*JoinRequest, error) {
+    var request JoinRequest
+    err := r.db.Where("room_id = ? AND user_id = ? AND status = ? AND expires_at > ?", roomID, userID, JoinRequestPending, time.Now()).
+        First(&request).Error
+    return &request, err
+}
+
+// FindPendingByRoom returns the live pending join requests to a room,
+// oldest first, with their users.
+func (r *joinRequestRepository) FindPendingByRoom(roomID uint) ([]JoinRequest, error) {
+    var requests []JoinRequest
+    err := r.db.Preload("User").
+        Where("room_id = ? AND status = ? AND expires_at > ?", roomID, JoinRequestPending, time.Now()).
+        Order("id").
+        Find(&requests).Error
+    return requests, err
+}
+
+// Approve marks the request approved and makes its user a member of the
+// room, atomically. It fails with ErrJoinRequestClosed unless the request
+// is pending and not expired, and with ErrBanned if its user is banned
+// from the room.
+func (r *joinRequestRepository) Approve(request *JoinRequest, reviewerID uint) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        if err := checkNotBanned(tx, request.RoomID, request.UserID); err != nil {
+            return err
+        }
+        if err := (&joinRequestRepository{db: tx}).review(request, reviewerID, JoinRequestApproved); err != nil {
+            return err
+        }
+        member := RoomMember{RoomID: request.RoomID, UserID: request.UserID}
+        return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+    })
+}
+
+// Reject marks the request rejected. It fails with ErrJoinRequestClosed
+// unless the request is pending and not expired.
+func (r *joinRequestRepository) Reject(request *JoinRequest, reviewerID uint) error {
+    return r.review(request, reviewerID, JoinRequestRejected)
+}
+
+func (r *joinRequestRepository) review(request *JoinRequest, reviewerID uint, status string) error {
+    now := time.Now()
+    result := r.db.Model(&JoinRequest{}).
+        Where("id = ? AND status = ? AND expires_at > ?", request.ID, JoinRequestPending, now).
+        Updates(map[string]interface{}{"status": status, "reviewer_id": reviewerID, "reviewed_at": now})
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrJoinRequestClosed
+    }
+    request.Status = status
+    request.ReviewerID = &reviewerID
+    request.ReviewedAt = &now
+    return nil
+}
+
+// Expire marks the pending requests that expired by now as expired and
+// returns them.
+func (r *joinRequestRepository) Expire(now time.Time) ([]JoinRequest, error) {
+    var requests []JoinRequest
+    err := r.db.Transaction(func(tx *gorm.DB) error {
+        err := tx.Where("status = ? AND expires_at <= ?", JoinRequestPending, now).Find(&requests).Error
+        if err != nil || len(requests) == 0 {
+            return err
+        }
+        ids := make([]uint, len(requests))
+        for i := range requests {
+            ids[i] = requests[i].ID
+            requests[i].Status = JoinRequestExpired
+        }
+        return tx.Model(&JoinRequest{}).
+            Where("id IN ? AND status = ?", ids, JoinRequestPending).
+            Update("status", JoinRequestExpired).Error
+    })
+    return requests, err
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Mention kinds, telling how a user was mentioned.
+const (
+    MentionKindUser = "user"
+    MentionKindRoom = "room"
+    MentionKindHere = "here"
+)
+
+// Mention records that a message pinged a user, by name or through @room
+// or @here. A message mentions each user at most once.
+type Mention struct {
+    ID        uint      `json:"id" gorm:"primaryKey"`
+    MessageID uint      `json:"message_id" gorm:"not null;uniqueIndex:idx_mentions_message_user,priority:1"`
+    Message   *Message  `json:"message,omitempty"`
+    UserID    uint      `json:"user_id" gorm:"not null;index;uniqueIndex:idx_mentions_message_user,priority:2"`
+    RoomID    uint      `json:"room_id" gorm:"not null"`
+    Kind      string    `json:"kind" gorm:"not null"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// MentionRepository interface
+type MentionRepository interface {
+    Create(mention *Mention) (bool, error)
+    FindByUser(userID uint, query MessageQuery) ([]Mention, error)
+}
+
+// mentionRepository implementation
+type mentionRepository struct {
+    db *gorm.DB
+}
+
+// NewMentionRepository creates new mention repository
+func NewMentionRepository(db *gorm.DB) MentionRepository {
+    return &mentionRepository{db: db}
+}
+
+// Create stores the mention. It reports false if the message already
+// mentioned the user, as when an edit keeps a mention.
+func (r *mentionRepository) Create(mention *Mention) (bool, error) {
+    result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(mention)
+    return result.RowsAffected > 0, result.Error
+}
+
+// FindByUser returns the mentions of a user, newest first, with their
+// messages. Mentions by deleted messages, and in rooms the user is no
+// longer a member of, are left out. Before is a mention ID cursor; After
+// is not supported.
+func (r *mentionRepository) FindByUser(userID uint, query MessageQuery) ([]Mention, error) {
+    tx := r.db.Preload("Message.User").
+        Joins("JOIN messages ON messages.id = mentions.message_id").
+        Joins("JOIN user_rooms ON user_rooms.room_id = mentions.room_id AND user_rooms.user_id = mentions.user_id").
+        Where("mentions.user_id = ? AND messages.deleted_at IS NULL", userID)
+    if query.Before != 0 {
+        tx = tx.Where("mentions.id < ?", query.Before)
+    }
+
+    var mentions []Mention
+    err := tx.Order("mentions.id DESC").Limit(query.Limit).Find(&mentions).Error
+    return mentions, err
+}
@@ -0,0 +1,274 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// Message model. Seq numbers the top-level messages of a room from 1
+// without gaps, so clients can detect and request what they missed.
+// Deleted messages stay as tombstones: their body is cleared and
+// DeletedAt is set.
+//
+// A reply has ParentID set to the root message of its thread; the root
+// keeps the ReplyCount and LastReplyAt of the thread. Replies only reach
+// the thread's participants and viewers, so they are numbered within
+// their thread instead: the Seq of a reply is its position in the thread,
+// and replies never advance the room's sequence.
+//
+// Reactions are not stored on the message; listings fill them in for the
+// user who asked.
+type Message struct {
+    ID          uint       `json:"id" gorm:"primaryKey"`
+    RoomID      uint       `json:"room_id" gorm:"index;not null;index:idx_messages_room_seq,priority:1"`
+    Room        *Room      `json:"-"`
+    Seq         uint64     `json:"seq" gorm:"not null;default:0;index:idx_messages_room_seq,priority:2"`
+    UserID      uint       `json:"user_id" gorm:"index;not null;uniqueIndex:idx_messages_user_client_msg,priority:1"`
+    User        *User      `json:"user,omitempty"`
+    Body        string     `json:"body" gorm:"not null"`
+    ParentID    *uint      `json:"parent_id,omitempty" gorm:"index"`
+    ReplyCount  int        `json:"reply_count" gorm:"not null;default:0"`
+    LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+    // ClientMsgID is the sender's idempotency key; a retried send with the
+    // same key returns the stored message instead of creating another.
+    ClientMsgID *string    `json:"client_msg_id,omitempty" gorm:"uniqueIndex:idx_messages_user_client_msg,priority:2"`
+    EditedAt    *time.Time `json:"edited_at,omitempty"`
+    DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+    DeletedByID *uint      `json:"deleted_by,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+    UpdatedAt   time.Time  `json:"updated_at"`
+
+    Reactions []ReactionSummary `json:"reactions,omitempty" gorm:"-"`
+}
+
+// MessageQuery selects a page of a room's history or of a thread. Before
+// and After are exclusive message ID cursors; at most one of them should
+// be set.
+type MessageQuery struct {
+    Before uint
+    After  uint
+    Limit  int
+}
+
+// MessageRepository interface
+type MessageRepository interface {
+    Create(message *Message) error
+    FindByID(id uint) (*Message, error)
+    FindByClientMsgID(userID uint, clientMsgID string) (*Message, error)
+    FindByRoom(roomID uint, query MessageQuery) ([]Message, error)
+    FindReplies(parentID uint, query MessageQuery) ([]Message, error)
+    FindThreadParticipants(parentID uint) ([]uint, error)
+    FindAfterSeq(roomID uint, seq uint64, limit int) ([]Message, error)
+    Edit(message *Message, body string, editorID uint) error
+    Delete(message *Message, deleterID uint) error
+    FindEdits(messageID uint) ([]MessageEdit, error)
+}
+
+// messageRepository implementation
+type messageRepository struct {
+    db *gorm.DB
+}
+
+// NewMessageRepository creates new message repository
+func NewMessageRepository(db *gorm.DB) MessageRepository {
+    return &messageRepository{db: db}
+}
+
+// Create stores the message with the next sequence number of its room,
+// or for a reply of its thread. The counter is bumped in the same
+// transaction, so concurrent writers never share or skip a number.
+// Replies also update the thread summary of their parent.
+func (r *messageRepository) Create(message *Message) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        if message.ParentID != nil {
+            return createReply(tx, message)
+        }
+
+        result := tx.Model(&Room{}).Where("id = ?", message.RoomID).UpdateColumn("last_seq", gorm.Expr("last_seq + 1"))
+        if result.Error != nil {
+            return result.Error
+        }
+        if result.RowsAffected == 0 {
+            return gorm.ErrRecordNotFound
+        }
+        if err := tx.Model(&Room{}).Where("id = ?", message.RoomID).Select("last_seq").Scan(&message.Seq).Error; err != nil {
+            return err
+        }
+        return tx.Create(message).Error
+    })
+}
+
+// createReply stores a reply with the next sequence number of its thread,
+// which is the reply count of its root.
+func createReply(tx *gorm.DB, message *Message) error {
+    result := tx.Model(&Message{}).
+        Where("id = ? AND room_id = ?", *message.ParentID, message.RoomID).
+        UpdateColumn("reply_count", gorm.Expr("reply_count + 1"))
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return gorm.ErrRecordNotFound
+    }
+    if err := tx.Model(&Message{}).Where("id = ?", *message.ParentID).Select("reply_count").Scan(&message.Seq).Error; err != nil {
+        return err
+    }
+    if err := tx.Create(message).Error; err != nil {
+        return err
+    }
+    return tx.Model(&Message{}).Where("id = ?", *message.ParentID).UpdateColumn("last_reply_at", message.CreatedAt).Error
+}
+
+func (r *messageRepository) FindByID(id uint) (*Message, error) {
+    var message Message
+    err := r.db.Preload("User").First(&message, id).Error
+    return &message, err
+}
+
+func (r *messageRepository) FindByClientMsgID(userID uint, clientMsgID string) (*Message, error) {
+    var message Message
+    err := r.db.Preload("User").Where("user_id = ? AND client_msg_id = ?", userID, clientMsgID).First(&message).Error
+    return &message, err
+}
+
+// FindByRoom returns the top-level messages of a room, without thread
+// replies, in chronological order.
+func (r *messageRepository) FindByRoom(roomID uint, query MessageQuery) ([]Message, error) {
+    return findPage(r.db.Where("room_id = ? AND parent_id IS NULL", roomID), query)
+}
+
+// FindReplies returns the replies of a thread in chronological order.
+func (r *messageRepository) FindReplies(parentID uint, query MessageQuery) ([]Message, error) {
+    return findPage(r.db.Where("parent_id = ?", parentID), query)
+}
+
+// FindThreadParticipants returns the IDs of the users who started or
+// replied to a thread and are still members of its room.
+func (r *messageRepository) FindThreadParticipants(parentID uint) ([]uint, error) {
+    var userIDs []uint
+    err := r.db.Model(&Message{}).
+        Distinct("messages.user_id").
+        Joins("JOIN user_rooms ON user_rooms.user_id = messages.user_id AND user_rooms.room_id = messages.room_id").
+        Where("messages.id = ? OR messages.parent_id = ?", parentID, parentID).
+        Pluck("messages.user_id", &userIDs).Error
+    return userIDs, err
+}
+
+// findPage returns a page of the messages selected by tx in chronological
+// order. With After set it walks forward from the cursor, otherwise it
+// returns the newest messages older than Before (or the newest overall).
+func findPage(tx *gorm.DB, query MessageQuery) ([]Message, error) {
+    var messages []Message
+    tx = tx.Preload("User").Limit(query.Limit)
+
+    if query.After != 0 {
+        err := tx.Where("id > ?", query.After).Order("id ASC").Find(&messages).Error
+        return messages, err
+    }
+
+    if query.Before != 0 {
+        tx = tx.Where("id < ?", query.Before)
+    }
+    if err := tx.Order("id DESC").Find(&messages).Error; err != nil {
+        return nil, err
+    }
+
+    for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+        messages[i], messages[j] = messages[j], messages[i]
+    }
+    return messages, nil
+}
+
+// FindAfterSeq returns up to limit top-level messages of the room with a
+// sequence number greater than seq, in order.
+func (r *messageRepository) FindAfterSeq(roomID uint, seq uint64, limit int) ([]Message, error) {
+    var messages []Message
+    err := r.db.Preload("User").
+        Where("room_id = ? AND parent_id IS NULL AND seq > ?", roomID, seq).
+        Order("seq ASC").
+        Limit(limit).
+        Find(&messages).Error
+    return messages, err
+}
+
+// Edit replaces the body of the message, keeping the previous one in its
+// edit history.
+func (r *messageRepository) Edit(message *Message, body string, editorID uint) error {
+    now := time.Now()
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        edit := MessageEdit{MessageID: message.ID, EditorID: editorID, Body: message.Body, CreatedAt: now}
+        if err := tx.Create(&edit).Error; err != nil {
+            return err
+        }
+        err := tx.Model(message).Updates(map[string]interface{}{"body": body, "edited_at": now}).Error
+        if err != nil {
+            return err
+        }
+        message.Body = body
+        message.EditedAt = &now
+        return nil
+    })
+}
+
+// Delete turns the message into a tombstone and drops its reactions. Its
+// edit history is kept.
+func (r *messageRepository) Delete(message *Message, deleterID uint) error {
+    now := time.Now()
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        err := tx.Model(message).Updates(map[string]interface{}{
+            "body":          "",
+            "deleted_at":    now,
+            "deleted_by_id": deleterID,
+        }).Error
+        if err != nil {
+            return err
+        }
+        if err := tx.Where("message_id = ?", message.ID).Delete(&Reaction{}).Error; err != nil {
+            return err
+        }
+        message.Body = ""
+        message.DeletedAt = &now
+        message.DeletedByID = &deleterID
+        return nil
+    })
+}
+
+// FindEdits returns the previous versions of a message, oldest first.
+func (r *messageRepository) FindEdits(messageID uint) ([]MessageEdit, error) {
+    var edits []MessageEdit
+    err := r.db.Where("message_id = ?", messageID).Order("id ASC").Find(&edits).Error
+    return edits, err
+}
+
+// BackfillMessageSeq numbers messages stored before sequence numbers
+// existed and initialises the room counters. It is a no-op once every
+// message has a sequence number.
+func BackfillMessageSeq(db *gorm.DB) error {
+    var pending int64
+    if err := db.Model(&Message{}).Where("seq = 0").Count(&pending).Error; err != nil {
+        return err
+    }
+    if pending == 0 {
+        return nil
+    }
+
+    return db.Transaction(func(tx *gorm.DB) error {
+        err := tx.Exec(`UPDATE messages SET seq = (
+            SELECT COUNT(*) FROM messages AS m
+            WHERE m.room_id = messages.room_id AND m.parent_id IS NULL AND m.id <= messages.id
+        ) WHERE parent_id IS NULL`).Error
+        if err != nil {
+            return err
+        }
+        err = tx.Exec(`UPDATE messages SET seq = (
+            SELECT COUNT(*) FROM messages AS m WHERE m.parent_id = messages.parent_id AND m.id <= messages.id
+        ) WHERE parent_id IS NOT NULL`).Error
+        if err != nil {
+            return err
+        }
+        return tx.Exec(`UPDATE rooms SET last_seq = (
+            SELECT COALESCE(MAX(seq), 0) FROM messages WHERE messages.room_id = rooms.id AND parent_id IS NULL
+        )`).Error
+    })
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// MessageEdit is a previous version of a message: Body is the text that
+// was replaced by EditorID at CreatedAt.
+type MessageEdit struct {
+    ID        uint      `json:"id" gorm:"primaryKey"`
+    MessageID uint      `json:"message_id" gorm:"index;not null"`
+    EditorID  uint      `json:"editor_id" gorm:"not null"`
+    Body      string    `json:"body" gorm:"not null"`
+    CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+    "errors"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// ErrTooManyReactions is returned by Add when the message already has the
+// maximum number of distinct emoji.
+var ErrTooManyReactions = errors.New("too many different reactions")
+
+// Reaction is one user's emoji on a message. Emoji is either a unicode
+// emoji or a custom :shortcode:; a user reacts with each emoji at most
+// once.
+type Reaction struct {
+    ID        uint      `json:"id" gorm:"primaryKey"`
+    MessageID uint      `json:"message_id" gorm:"not null;uniqueIndex:idx_reactions_message_user_emoji,priority:1"`
+    UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_reactions_message_user_emoji,priority:2"`
+    Emoji     string    `json:"emoji" gorm:"not null;uniqueIndex:idx_reactions_message_user_emoji,priority:3"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionSummary aggregates the reactions with one emoji on a message.
+// Me tells whether the user the summary was made for is among them.
+type ReactionSummary struct {
+    Emoji string `json:"emoji"`
+    Count int64  `json:"count"`
+    Me    bool   `json:"me"`
+}
+
+// ReactionRepository interface
+type ReactionRepository interface {
+    Add(reaction *Reaction, maxEmoji int) (bool, error)
+    Remove(messageID uint, userID uint, emoji string) (bool, error)
+    Count(messageID uint, emoji string) (int64, error)
+    Summarize(messageIDs []uint, userID uint) (map[uint][]ReactionSummary, error)
+}
+
+// reactionRepository implementation
+type reactionRepository struct {
+    db *gorm.DB
+}
+
+// NewReactionRepository creates new reaction repository
+func NewReactionRepository(db *gorm.DB) ReactionRepository {
+    return &reactionRepository{db: db}
+}
+
+// Add stores the reaction unless the user already reacted with that
+// emoji, which it reports as false. A new emoji is refused with
+// ErrTooManyReactions once the message has maxEmoji distinct ones.
+func (r *reactionRepository) Add(reaction *Reaction, maxEmoji int) (bool, error) {
+    added := false
+    err := r.db.Transaction(func(tx *gorm.DB) error {
+        var emoji []string
+        err := tx.Model(&Reaction{}).Where("message_id = ?", reaction.MessageID).Distinct().Pluck("emoji", &emoji).Error
+        if err != nil {
+            return err
+        }
+        known := false
+        for _, e := range emoji {
+            if e == reaction.Emoji {
+                known = true
+                break
+            }
+        }
+        if !known && len(emoji) >= maxEmoji {
+            return ErrTooManyReactions
+        }
+
+        result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(reaction)
+        added = result.RowsAffected > 0
+        return result.Error
+    })
+    return added, err
+}
+
+// Remove deletes the user's reaction with emoji. It reports false when
+// there was none.
+func (r *reactionRepository) Remove(messageID uint, userID uint, emoji string) (bool, error) {
+    result := r.db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).Delete(&Reaction{})
+    return result.RowsAffected > 0, result.Error
+}
+
+// Count returns how many users reacted to the message with emoji.
+func (r *reactionRepository) Count(messageID uint, emoji string) (int64, error) {
+    var count int64
+    err := r.db.Model(&Reaction{}).Where("message_id = ? AND emoji = ?", messageID, emoji).Count(&count).Error
+    return count, err
+}
+
+// Summarize returns the reactions of each message, keyed by message ID,
+// as seen by userID. Emoji are ordered by their first use.
+func (r *reactionRepository) Summarize(messageIDs []uint, userID uint) (map[uint][]ReactionSummary, error) {
+    summaries := make(map[uint][]ReactionSummary)
+    if len(messageIDs) == 0 {
+        return summaries, nil
+    }
+
+    var rows []struct {
+        MessageID uint
+        Emoji     string
+        Count     int64
+        Me        bool
+    }
+    err := r.db.Model(&Reaction{}).
+        Select("message_id, emoji, COUNT(*) AS count, MAX(user_id = ?) AS me", userID).
+        Where("message_id IN ?", messageIDs).
+        Group("message_id, emoji").
+        Order("MIN(id)").
+        Scan(&rows).Error
+    if err != nil {
+        return nil, err
+    }
+
+    for _, row := range rows {
+        summaries[row.MessageID] = append(summaries[row.MessageID], ReactionSummary{
+            Emoji: row.Emoji,
+            Count: row.Count,
+            Me:    row.Me,
+        })
+    }
+    return summaries, nil
+}
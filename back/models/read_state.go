@@ -0,0 +1,82 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// ReadState records the last message a member has read in a room. It is
+// keyed like the user_rooms membership it belongs to.
+type ReadState struct {
+    UserID            uint      `json:"user_id" gorm:"primaryKey"`
+    RoomID            uint      `json:"room_id" gorm:"primaryKey"`
+    LastReadMessageID uint      `json:"last_read_message_id"`
+    UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// RoomReadSummary is a member's read position and unread count in a room.
+type RoomReadSummary struct {
+    RoomID            uint
+    LastReadMessageID uint
+    UnreadCount       int64
+}
+
+// ReadStateRepository interface
+type ReadStateRepository interface {
+    MarkRead(userID uint, roomID uint, messageID uint) (bool, error)
+    Find(userID uint, roomID uint) (*ReadState, error)
+    FindSummaries(userID uint) ([]RoomReadSummary, error)
+}
+
+// readStateRepository implementation
+type readStateRepository struct {
+    db *gorm.DB
+}
+
+// NewReadStateRepository creates new read state repository
+func NewReadStateRepository(db *gorm.DB) ReadStateRepository {
+    return &readStateRepository{db: db}
+}
+
+// MarkRead moves the read position forward to messageID. It reports false
+// when the user had already read up to or past it.
+func (r *readStateRepository) MarkRead(userID uint, roomID uint, messageID uint) (bool, error) {
+    state := ReadState{UserID: userID, RoomID: roomID, LastReadMessageID: messageID}
+    result := r.db.Clauses(clause.OnConflict{
+        Columns:   []clause.Column{{Name: "user_id"}, {Name: "room_id"}},
+        DoUpdates: clause.AssignmentColumns([]string{"last_read_message_id", "updated_at"}),
+        Where: clause.Where{Exprs: []clause.Expression{
+            clause.Expr{SQL: "excluded.last_read_message_id > read_states.last_read_message_id"},
+        }},
+    }).Create(&state)
+    return result.RowsAffected > 0, result.Error
+}
+
+func (r *readStateRepository) Find(userID uint, roomID uint) (*ReadState, error) {
+    var state ReadState
+    err := r.db.Where("user_id = ? AND room_id = ?", userID, roomID).First(&state).Error
+    return &state, err
+}
+
+// FindSummaries returns the read position and the number of unread
+// top-level messages from other users, deleted ones excluded, for every
+// room the user is a member of.
+func (r *readStateRepository) FindSummaries(userID uint) ([]RoomReadSummary, error) {
+    var summaries []RoomReadSummary
+    err := r.db.Table("user_rooms").
+        Select(`user_rooms.room_id AS room_id,
+            COALESCE(read_states.last_read_message_id, 0) AS last_read_message_id,
+            COUNT(messages.id) AS unread_count`).
+        Joins("LEFT JOIN read_states ON read_states.user_id = user_rooms.user_id AND read_states.room_id = user_rooms.room_id").
+        Joins(`LEFT JOIN messages ON messages.room_id = user_rooms.room_id
+            AND messages.id > COALESCE(read_states.last_read_message_id, 0)
+            AND messages.user_id <> user_rooms.user_id
+            AND messages.deleted_at IS NULL
+            AND messages.parent_id IS NULL`).
+        Where("user_rooms.user_id = ?", userID).
+        Group("user_rooms.room_id, read_states.last_read_message_id").
+        Scan(&summaries).Error
+    return summaries, err
+}
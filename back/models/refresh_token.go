@@ -0,0 +1,72 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// RefreshToken model. Tokens are single-use: refreshing revokes the
+// presented token and issues a new one in the same family, so presenting
+// a revoked token means it was stolen and the whole family is revoked.
+type RefreshToken struct {
+    ID        uint       `json:"id" gorm:"primaryKey"`
+    UserID    uint       `json:"user_id" gorm:"index;not null"`
+    FamilyID  string     `json:"family_id" gorm:"index;not null"`
+    TokenHash string     `json:"-" gorm:"uniqueIndex;not null"`
+    ExpiresAt time.Time  `json:"expires_at"`
+    RevokedAt *time.Time `json:"revoked_at"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+// RefreshTokenRepository interface
+type RefreshTokenRepository interface {
+    Create(token *RefreshToken) error
+    FindByHash(tokenHash string) (*RefreshToken, error)
+    Revoke(id uint) (bool, error)
+    RevokeFamily(familyID string) error
+    RevokeUser(userID uint) error
+}
+
+// refreshTokenRepository implementation
+type refreshTokenRepository struct {
+    db *gorm.DB
+}
+
+// NewRefreshTokenRepository creates new refresh token repository
+func NewRefreshTokenRepository(db *gorm.DB) RefreshTokenRepository {
+    return &refreshTokenRepository{db: db}
+}
+
+func (r *refreshTokenRepository) Create(token *RefreshToken) error {
+    return r.db.Create(token).Error
+}
+
+func (r *refreshTokenRepository) FindByHash(tokenHash string) (*RefreshToken, error) {
+    var token RefreshToken
+    err := r.db.Where("token_hash = ?", tokenHash).First(&token).Error
+    return &token, err
+}
+
+// Revoke marks a token as used. It reports false when the token had
+// already been revoked, which lets callers detect concurrent reuse.
+func (r *refreshTokenRepository) Revoke(id uint) (bool, error) {
+    result := r.db.Model(&RefreshToken{}).
+        Where("id = ? AND revoked_at IS NULL", id).
+        Update("revoked_at", time.Now())
+    return result.RowsAffected == 1, result.Error
+}
+
+func (r *refreshTokenRepository) RevokeFamily(familyID string) error {
+    return r.db.Model(&RefreshToken{}).
+        Where("family_id = ? AND revoked_at IS NULL", familyID).
+        Update("revoked_at", time.Now()).Error
+}
+
+// RevokeUser revokes every refresh token of the user, ending all their
+// sessions.
+func (r *refreshTokenRepository) RevokeUser(userID uint) error {
+    return r.db.Model(&RefreshToken{}).
+        Where("user_id = ? AND revoked_at IS NULL", userID).
+        Update("revoked_at", time.Now()).Error
+}
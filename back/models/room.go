@@ -1,21 +1,116 @@
 package models
 
-import "gorm.io/gorm"
+import (
+    "fmt"
+    "time"
 
-// Room model
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Room kinds.
+const (
+    RoomKindRoom  = "room"
+    RoomKindDM    = "dm"
+    RoomKindGroup = "group"
+)
+
+// Room visibilities. Anyone can join a public room. Restricted rooms are
+// listed, but users ask to join them and a moderator approves. Private
+// rooms are hidden from non-members and can only be entered by
+// invitation. Conversations are always private.
+const (
+    VisibilityPublic     = "public"
+    VisibilityRestricted = "restricted"
+    VisibilityPrivate    = "private"
+)
+
+// Room model. LastSeq is the sequence number of the newest top-level
+// message; thread replies are numbered within their thread.
+//
+// A direct message conversation is a room of kind "dm" with exactly two
+// members and no name. DMKey identifies the pair so it only ever gets
+// one conversation. Group DMs (kind "group") are unnamed conversations
+// between a few users; they can be promoted to regular rooms.
+//
+// An archived room keeps its history but is read-only and left out of
+// the default room listing.
 type Room struct {
-    ID          uint   `json:"id" gorm:"primaryKey"`
-    Name        string `json:"name"`
-    Description string `json:"description"`
-    Users       []User `json:"users" gorm:"many2many:user_rooms;"`
+    ID          uint       `json:"id" gorm:"primaryKey"`
+    Name        string     `json:"name"`
+    Description string     `json:"description"`
+    Kind        string     `json:"kind" gorm:"not null;default:room;index"`
+    Visibility  string     `json:"visibility" gorm:"not null;default:public"`
+    DMKey       *string    `json:"-" gorm:"uniqueIndex"`
+    LastSeq     uint64     `json:"last_seq" gorm:"not null;default:0"`
+    ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+    Users       []User     `json:"users" gorm:"many2many:user_rooms;"`
+}
+
+// IsDM reports whether the room is a 1:1 direct message conversation.
+func (r *Room) IsDM() bool {
+    return r.Kind == RoomKindDM
+}
+
+// IsArchived reports whether the room is read-only.
+func (r *Room) IsArchived() bool {
+    return r.ArchivedAt != nil
+}
+
+// IsConversation reports whether the room is a 1:1 or group DM.
+func (r *Room) IsConversation() bool {
+    return r.Kind == RoomKindDM || r.Kind == RoomKindGroup
+}
+
+// IsPrivate reports whether only the room's members can see it and
+// nobody can join it on their own: DMs and private rooms.
+func (r *Room) IsPrivate() bool {
+    return r.IsConversation() || r.Visibility == VisibilityPrivate
+}
+
+// IsOpen reports whether anyone can join the room on their own.
+func (r *Room) IsOpen() bool {
+    return !r.IsConversation() && r.Visibility == VisibilityPublic
+}
+
+// ValidVisibility reports whether visibility is one of the room
+// visibilities.
+func ValidVisibility(visibility string) bool {
+    switch visibility {
+    case VisibilityPublic, VisibilityRestricted, VisibilityPrivate:
+        return true
+    }
+    return false
+}
+
+// dmKey identifies the DM between two users regardless of their order.
+func dmKey(userID uint, otherID uint) string {
+    if userID > otherID {
+        userID, otherID = otherID, userID
+    }
+    return fmt.Sprintf("%d:%d", userID, otherID)
 }
 
 // RoomRepository interface
 type RoomRepository interface {
-    Create(room *Room) error
-    FindAll() ([]Room, error)
+    Create(room *Room, ownerID uint) error
+    Update(room *Room) error
+    Delete(id uint) error
+    FindAll(userID uint, includeArchived bool) ([]Room, error)
     FindByID(id uint) (*Room, error)
     AddUser(roomID uint, userID uint) error
+    RemoveUser(roomID uint, userID uint) error
+    AddUsers(roomID uint, userIDs []uint) error
+    IsMember(roomID uint, userID uint) (bool, error)
+    FindIDsByUser(userID uint) ([]uint, error)
+    FindOrCreateDM(userID uint, otherID uint) (*Room, bool, error)
+    CreateGroup(userIDs []uint) (*Room, error)
+    FindDMsByUser(userID uint) ([]Room, error)
+    FindMember(roomID uint, userID uint) (*RoomMember, error)
+    FindMembers(roomID uint) ([]RoomMember, error)
+    SetRole(roomID uint, userID uint, role string) error
+    TransferOwnership(roomID uint, fromID uint, toID uint) error
+    Promote(room *Room, ownerID uint) error
 }
 
 // roomRepository implementation
@@ -28,13 +123,69 @@ func NewRoomRepository(db *gorm.DB) RoomRepository {
     return &roomRepository{db: db}
 }
 
-func (r *roomRepository) Create(room *Room) error {
-    return r.db.Create(room).Error
+// Create stores a new room with ownerID as its owner and only member.
+func (r *roomRepository) Create(room *Room, ownerID uint) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Omit("Users").Create(room).Error; err != nil {
+            return err
+        }
+        return tx.Create(&RoomMember{RoomID: room.ID, UserID: ownerID, Role: RoleOwner}).Error
+    })
 }
 
-func (r *roomRepository) FindAll() ([]Room, error) {
+// Update saves the room's name, description, kind, visibility and archive
+// state. Its members and message counter are left alone.
+func (r *roomRepository) Update(room *Room) error {
+    return r.db.Model(room).Select("Name", "Description", "Kind", "Visibility", "ArchivedAt").Updates(room).Error
+}
+
+// Delete removes the room with its members, messages and everything
+// attached to them.
+func (r *roomRepository) Delete(id uint) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        messageIDs := tx.Model(&Message{}).Select("id").Where("room_id = ?", id)
+        steps := []*gorm.DB{
+            tx.Where("message_id IN (?)", messageIDs).Delete(&Reaction{}),
+            tx.Where("message_id IN (?)", messageIDs).Delete(&MessageEdit{}),
+            tx.Where("room_id = ?", id).Delete(&Mention{}),
+            tx.Where("room_id = ?", id).Delete(&Message{}),
+            tx.Where("room_id = ?", id).Delete(&ReadState{}),
+            tx.Where("room_id = ?", id).Delete(&Invitation{}),
+            tx.Where("room_id = ?", id).Delete(&InviteLink{}),
+            tx.Where("room_id = ?", id).Delete(&JoinRequest{}),
+            tx.Where("room_id = ?", id).Delete(&Sanction{}),
+            tx.Where("room_id = ?", id).Delete(&AuditLog{}),
+            tx.Exec("DELETE FROM user_rooms WHERE room_id = ?", id),
+        }
+        for _, step := range steps {
+            if step.Error != nil {
+                return step.Error
+            }
+        }
+        result := tx.Delete(&Room{}, id)
+        if result.Error != nil {
+            return result.Error
+        }
+        if result.RowsAffected == 0 {
+            return gorm.ErrRecordNotFound
+        }
+        return nil
+    })
+}
+
+// FindAll returns the rooms userID can see: public and restricted rooms
+// and the private rooms they belong to, without direct message conversations and, unless
+// includeArchived is set, without archived rooms.
+func (r *roomRepository) FindAll(userID uint, includeArchived bool) ([]Room, error) {
     var rooms []Room
-    err := r.db.Preload("Users").Find(&rooms).Error
+    memberRoomIDs := r.db.Table("user_rooms").Select("room_id").Where("user_id = ?", userID)
+    tx := r.db.Preload("Users").
+        Where("kind = ?", RoomKindRoom).
+        Where("visibility <> ? OR id IN (?)", VisibilityPrivate, memberRoomIDs)
+    if !includeArchived {
+        tx = tx.Where("archived_at IS NULL")
+    }
+    err := tx.Find(&rooms).Error
     return rooms, err
 }
 
@@ -44,6 +195,8 @@ func (r *roomRepository) FindByID(id uint) (*Room, error) {
     return &room, err
 }
 
+// AddUser makes the user a member of the room. It fails with ErrBanned
+// if they are banned from it.
 func (r *roomRepository) AddUser(roomID uint, userID uint) error {
     var room Room
     var user User
@@ -56,5 +209,173 @@ func (r *roomRepository) AddUser(roomID uint, userID uint) error {
         return err
     }
     
+    if err := checkNotBanned(r.db, roomID, userID); err != nil {
+        return err
+    }
+    
     return r.db.Model(&room).Association("Users").Append(&user)
-}
\ No newline at end of file
+}
+
+// AddUsers adds several users to a room at once. It fails with
+// gorm.ErrRecordNotFound, adding nobody, if any of them does not exist.
+func (r *roomRepository) AddUsers(roomID uint, userIDs []uint) error {
+    var users []User
+    if err := r.db.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+        return err
+    }
+    if len(users) != len(userIDs) {
+        return gorm.ErrRecordNotFound
+    }
+    return r.db.Model(&Room{ID: roomID}).Association("Users").Append(&users)
+}
+
+// RemoveUser takes the user out of the room. Their messages stay.
+func (r *roomRepository) RemoveUser(roomID uint, userID uint) error {
+    return removeMember(r.db, roomID, userID)
+}
+
+// removeMember deletes the membership of the user in the room along with
+// their read state.
+func removeMember(db *gorm.DB, roomID uint, userID uint) error {
+    if err := db.Exec("DELETE FROM user_rooms WHERE room_id = ? AND user_id = ?", roomID, userID).Error; err != nil {
+        return err
+    }
+    return db.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&ReadState{}).Error
+}
+
+func (r *roomRepository) IsMember(roomID uint, userID uint) (bool, error) {
+    var count int64
+    err := r.db.Table("user_rooms").
+        Where("room_id = ? AND user_id = ?", roomID, userID).
+        Count(&count).Error
+    return count > 0, err
+}
+
+func (r *roomRepository) FindIDsByUser(userID uint) ([]uint, error) {
+    var roomIDs []uint
+    err := r.db.Table("user_rooms").
+        Where("user_id = ?", userID).
+        Pluck("room_id", &roomIDs).Error
+    return roomIDs, err
+}
+
+// FindOrCreateDM returns the direct message conversation between two
+// users, creating it if they have none yet. The bool reports whether it
+// was created.
+func (r *roomRepository) FindOrCreateDM(userID uint, otherID uint) (*Room, bool, error) {
+    key := dmKey(userID, otherID)
+    var room Room
+    err := r.db.Preload("Users").Where("dm_key = ?", key).First(&room).Error
+    if err == nil {
+        return &room, false, nil
+    }
+    if err != gorm.ErrRecordNotFound {
+        return nil, false, err
+    }
+
+    var users []User
+    if err := r.db.Where("id IN ?", []uint{userID, otherID}).Find(&users).Error; err != nil {
+        return nil, false, err
+    }
+    if len(users) != 2 {
+        return nil, false, gorm.ErrRecordNotFound
+    }
+
+    room = Room{Kind: RoomKindDM, Visibility: VisibilityPrivate, DMKey: &key, Users: users}
+    if err := r.db.Create(&room).Error; err != nil {
+        // Both users may have opened the conversation at the same time.
+        var existing Room
+        if findErr := r.db.Preload("Users").Where("dm_key = ?", key).First(&existing).Error; findErr == nil {
+            return &existing, false, nil
+        }
+        return nil, false, err
+    }
+    return &room, true, nil
+}
+
+// CreateGroup creates a group DM between the users. It fails with
+// gorm.ErrRecordNotFound if any of them does not exist.
+func (r *roomRepository) CreateGroup(userIDs []uint) (*Room, error) {
+    var users []User
+    if err := r.db.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+        return nil, err
+    }
+    if len(users) != len(userIDs) {
+        return nil, gorm.ErrRecordNotFound
+    }
+
+    room := Room{Kind: RoomKindGroup, Visibility: VisibilityPrivate, Users: users}
+    if err := r.db.Create(&room).Error; err != nil {
+        return nil, err
+    }
+    return &room, nil
+}
+
+// FindDMsByUser returns the 1:1 and group DMs of a user.
+func (r *roomRepository) FindDMsByUser(userID uint) ([]Room, error) {
+    var rooms []Room
+    err := r.db.Preload("Users").
+        Joins("JOIN user_rooms ON user_rooms.room_id = rooms.id").
+        Where("user_rooms.user_id = ? AND rooms.kind IN ?", userID, []string{RoomKindDM, RoomKindGroup}).
+        Order("rooms.id").
+        Find(&rooms).Error
+    return rooms, err
+}
+
+func (r *roomRepository) FindMember(roomID uint, userID uint) (*RoomMember, error) {
+    var member RoomMember
+    err := r.db.Where("room_id = ? AND user_id = ?", roomID, userID).First(&member).Error
+    return &member, err
+}
+
+// FindMembers returns the members of a room with their users, the most
+// privileged first.
+func (r *roomRepository) FindMembers(roomID uint) ([]RoomMember, error) {
+    var members []RoomMember
+    err := r.db.Preload("User").
+        Where("room_id = ?", roomID).
+        Order(clause.OrderBy{Expression: clause.Expr{
+            SQL:                "CASE role WHEN ? THEN 0 WHEN ? THEN 1 ELSE 2 END, joined_at",
+            Vars:               []interface{}{RoleOwner, RoleModerator},
+            WithoutParentheses: true,
+        }}).
+        Find(&members).Error
+    return members, err
+}
+
+// SetRole changes the role of a member. It fails with
+// gorm.ErrRecordNotFound if the user is not a member.
+func (r *roomRepository) SetRole(roomID uint, userID uint, role string) error {
+    result := r.db.Model(&RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Update("role", role)
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return gorm.ErrRecordNotFound
+    }
+    return nil
+}
+
+// TransferOwnership makes toID the owner of the room and the previous
+// owner fromID a moderator, atomically.
+func (r *roomRepository) TransferOwnership(roomID uint, fromID uint, toID uint) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        repo := &roomRepository{db: tx}
+        if err := repo.SetRole(roomID, toID, RoleOwner); err != nil {
+            return err
+        }
+        return repo.SetRole(roomID, fromID, RoleModerator)
+    })
+}
+
+// Promote saves a group conversation turned into a room and makes ownerID
+// its owner, atomically.
+func (r *roomRepository) Promote(room *Room, ownerID uint) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        repo := &roomRepository{db: tx}
+        if err := repo.Update(room); err != nil {
+            return err
+        }
+        return repo.SetRole(room.ID, ownerID, RoleOwner)
+    })
+}
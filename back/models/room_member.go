@@ -0,0 +1,77 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// Member roles, from least to most privileged.
+const (
+    RoleMember    = "member"
+    RoleModerator = "moderator"
+    RoleOwner     = "owner"
+)
+
+var roleRank = map[string]int{RoleMember: 0, RoleModerator: 1, RoleOwner: 2}
+
+// RoomMember is the user_rooms join row behind Room.Users and User.Rooms.
+// Every regular room has one owner; direct message conversations only
+// have members.
+type RoomMember struct {
+    RoomID   uint       `json:"room_id" gorm:"primaryKey"`
+    UserID   uint       `json:"user_id" gorm:"primaryKey"`
+    User     *User      `json:"user,omitempty"`
+    Role     string     `json:"role" gorm:"not null;default:member"`
+    JoinedAt *time.Time `json:"joined_at,omitempty"`
+}
+
+// TableName keeps the table of the former bare many2many join.
+func (RoomMember) TableName() string {
+    return "user_rooms"
+}
+
+// BeforeCreate fills in the defaults for rows created through the Users
+// association.
+func (m *RoomMember) BeforeCreate(tx *gorm.DB) error {
+    if m.Role == "" {
+        m.Role = RoleMember
+    }
+    if m.JoinedAt == nil {
+        now := time.Now()
+        m.JoinedAt = &now
+    }
+    return nil
+}
+
+// HasRole reports whether the member has role or a more privileged one.
+func (m *RoomMember) HasRole(role string) bool {
+    return roleRank[m.Role] >= roleRank[role]
+}
+
+// ValidRole reports whether role is one of the member roles.
+func ValidRole(role string) bool {
+    _, ok := roleRank[role]
+    return ok
+}
+
+// SetupRoomMembers registers RoomMember as the join model of Room.Users
+// and User.Rooms. It must run before migrating or using either.
+func SetupRoomMembers(db *gorm.DB) error {
+    if err := db.SetupJoinTable(&Room{}, "Users", &RoomMember{}); err != nil {
+        return err
+    }
+    return db.SetupJoinTable(&User{}, "Rooms", &RoomMember{})
+}
+
+// BackfillRoomOwners makes the earliest member of every regular room
+// without an owner its owner, for rooms created before roles existed.
+func BackfillRoomOwners(db *gorm.DB) error {
+    return db.Exec(`UPDATE user_rooms SET role = ? WHERE rowid IN (
+        SELECT MIN(user_rooms.rowid) FROM user_rooms
+        JOIN rooms ON rooms.id = user_rooms.room_id
+        WHERE rooms.kind = ?
+        GROUP BY user_rooms.room_id
+        HAVING SUM(user_rooms.role = ?) = 0
+    )`, RoleOwner, RoomKindRoom, RoleOwner).Error
+}
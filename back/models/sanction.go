@@ -0,0 +1,154 @@
+package models
+
+import (
+    "errors"
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// Sanction kinds. A banned user cannot be a member of the room; a muted
+// member can read but not post.
+const (
+    SanctionBan  = "ban"
+    SanctionMute = "mute"
+)
+
+// ErrBanned is returned when adding a user to a room they are banned
+// from.
+var ErrBanned = errors.New("user is banned from this room")
+
+// Sanction is a ban or mute imposed on a user in a room by a moderator.
+// It is in force until ExpiresAt, or for good if that is nil, unless it
+// is lifted earlier. Once expired it is marked lifted at ExpiresAt, with
+// no LiftedByID.
+type Sanction struct {
+    ID          uint       `json:"id" gorm:"primaryKey"`
+    RoomID      uint       `json:"room_id" gorm:"not null;index:idx_sanctions_room_user,priority:1"`
+    UserID      uint       `json:"user_id" gorm:"not null;index:idx_sanctions_room_user,priority:2"`
+    User        *User      `json:"user,omitempty"`
+    Kind        string     `json:"kind" gorm:"not null"`
+    ModeratorID uint       `json:"moderator_id" gorm:"not null"`
+    Reason      string     `json:"reason,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+    ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+    LiftedAt    *time.Time `json:"lifted_at,omitempty"`
+    LiftedByID  *uint      `json:"lifted_by_id,omitempty"`
+}
+
+// activeSanctions limits a query to sanctions in force at now.
+func activeSanctions(now time.Time) func(*gorm.DB) *gorm.DB {
+    return func(db *gorm.DB) *gorm.DB {
+        return db.Where("lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", now)
+    }
+}
+
+// checkNotBanned fails with ErrBanned if the user is banned from the
+// room. Joining, accepting an invitation or invite link and approving a
+// join request go through it. AddUsers does not, as it only adds people
+// to group conversations, which have no sanctions.
+func checkNotBanned(db *gorm.DB, roomID uint, userID uint) error {
+    var count int64
+    err := db.Model(&Sanction{}).Scopes(activeSanctions(time.Now())).
+        Where("room_id = ? AND user_id = ? AND kind = ?", roomID, userID, SanctionBan).
+        Count(&count).Error
+    if err != nil {
+        return err
+    }
+    if count > 0 {
+        return ErrBanned
+    }
+    return nil
+}
+
+// SanctionRepository interface
+type SanctionRepository interface {
+    Create(sanction *Sanction) error
+    FindActive(roomID uint, userID uint) ([]Sanction, error)
+    FindActiveByRoom(roomID uint, kind string) ([]Sanction, error)
+    Lift(sanction *Sanction, liftedByID uint) error
+    Expire(now time.Time) ([]Sanction, error)
+}
+
+// sanctionRepository implementation
+type sanctionRepository struct {
+    db *gorm.DB
+}
+
+// NewSanctionRepository creates new sanction repository
+func NewSanctionRepository(db *gorm.DB) SanctionRepository {
+    return &sanctionRepository{db: db}
+}
+
+// Create stores the sanction. A ban also takes the user out of the room,
+// in the same transaction. It fails with gorm.ErrRecordNotFound if the
+// user does not exist.
+func (r *sanctionRepository) Create(sanction *Sanction) error {
+    return r.db.Transaction(func(tx *gorm.DB) error {
+        var user User
+        if err := tx.Select("id").First(&user, sanction.UserID).Error; err != nil {
+            return err
+        }
+        if err := tx.Create(sanction).Error; err != nil {
+            return err
+        }
+        if sanction.Kind != SanctionBan {
+            return nil
+        }
+        return removeMember(tx, sanction.RoomID, sanction.UserID)
+    })
+}
+
+// FindActive returns the bans and mutes of a user in a room that are in
+// force.
+func (r *sanctionRepository) FindActive(roomID uint, userID uint) ([]Sanction, error) {
+    var sanctions []Sanction
+    err := r.db.Scopes(activeSanctions(time.Now())).
+        Where("room_id = ? AND user_id = ?", roomID, userID).
+        Find(&sanctions).Error
+    return sanctions, err
+}
+
+// FindActiveByRoom returns the sanctions of a kind in force in a room,
+// newest first, with their users.
+func (r *sanctionRepository) FindActiveByRoom(roomID uint, kind string) ([]Sanction, error) {
+    var sanctions []Sanction
+    err := r.db.Preload("User").Scopes(activeSanctions(time.Now())).
+        Where("room_id = ? AND kind = ?", roomID, kind).
+        Order("id DESC").
+        Find(&sanctions).Error
+    return sanctions, err
+}
+
+// Lift ends the sanction before it expires.
+func (r *sanctionRepository) Lift(sanction *Sanction, liftedByID uint) error {
+    now := time.Now()
+    err := r.db.Model(sanction).Updates(map[string]interface{}{"lifted_at": now, "lifted_by_id": liftedByID}).Error
+    if err != nil {
+        return err
+    }
+    sanction.LiftedAt = &now
+    sanction.LiftedByID = &liftedByID
+    return nil
+}
+
+// Expire marks the sanctions that expired by now as lifted at their
+// expiry and returns them.
+func (r *sanctionRepository) Expire(now time.Time) ([]Sanction, error) {
+    var sanctions []Sanction
+    err := r.db.Transaction(func(tx *gorm.DB) error {
+        err := tx.Where("lifted_at IS NULL AND expires_at <= ?", now).Find(&sanctions).Error
+        if err != nil || len(sanctions) == 0 {
+            return err
+        }
+        ids := make([]uint, len(sanctions))
+        for i := range sanctions {
+            ids[i] = sanctions[i].ID
+            sanctions[i].LiftedAt = sanctions[i].ExpiresAt
+        }
+        return tx.Model(&Sanction{}).
+            Where("id IN ? AND lifted_at IS NULL", ids).
+            Update("lifted_at", gorm.Expr("expires_at")).Error
+    })
+    return sanctions, err
+}
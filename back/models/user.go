@@ -1,20 +1,70 @@
 package models
 
-import "gorm.io/gorm"
+import (
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/gorm"
+)
 
 // User model
 type User struct {
     ID    uint   `json:"id" gorm:"primaryKey"`
-    Name  string `json:"name"`
+    Name  string `json:"name" gorm:"uniqueIndex"`
     Email string `json:"email" gorm:"unique"`
     Rooms []Room `json:"rooms" gorm:"many2many:user_rooms;"`
+
+    // PasswordHash is empty for accounts created before passwords existed;
+    // those users must go through the password setup flow.
+    PasswordHash           string     `json:"-"`
+    PasswordSetupTokenHash string     `json:"-" gorm:"index"`
+    PasswordSetupExpiresAt *time.Time `json:"-"`
+}
+
+// SetPassword hashes password with bcrypt and stores it on the user.
+func (u *User) SetPassword(password string) error {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+    u.PasswordHash = string(hash)
+    return nil
+}
+
+// CheckPassword reports whether password matches the stored hash.
+func (u *User) CheckPassword(password string) bool {
+    if u.PasswordHash == "" {
+        return false
+    }
+    return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// HasPassword reports whether the user has set a password.
+func (u *User) HasPassword() bool {
+    return u.PasswordHash != ""
+}
+
+// DedupeUserNames renames users whose name an earlier user already has
+// to "name-id", so the unique index on names can be created. It must run
+// before migrating User.
+func DedupeUserNames(db *gorm.DB) error {
+    if !db.Migrator().HasTable(&User{}) {
+        return nil
+    }
+    return db.Exec(`UPDATE users SET name = name || '-' || id WHERE id NOT IN (
+        SELECT MIN(id) FROM users GROUP BY name
+    )`).Error
 }
 
 // UserRepository interface
 type UserRepository interface {
     Create(user *User) error
+    Update(user *User) error
     FindAll() ([]User, error)
     FindByID(id uint) (*User, error)
+    FindByName(name string) (*User, error)
+    FindByEmail(email string) (*User, error)
+    FindByPasswordSetupToken(tokenHash string) (*User, error)
 }
 
 // userRepository implementation
@@ -31,6 +81,10 @@ func (r *userRepository) Create(user *User) error {
     return r.db.Create(user).Error
 }
 
+func (r *userRepository) Update(user *User) error {
+    return r.db.Omit("Rooms").Save(user).Error
+}
+
 func (r *userRepository) FindAll() ([]User, error) {
     var users []User
     err := r.db.Find(&users).Error
@@ -41,4 +95,23 @@ func (r *userRepository) FindByID(id uint) (*User, error) {
     var user User
     err := r.db.First(&user, id).Error
     return &user, err
-}
\ No newline at end of file
+}
+
+func (r *userRepository) FindByName(name string) (*User, error) {
+    var user User
+    err := r.db.Where("name = ?", name).First(&user).Error
+    return &user, err
+}
+
+func (r *userRepository) FindByEmail(email string) (*User, error) {
+    var user User
+    err := r.db.Where("email = ?", email).First(&user).Error
+    return &user, err
+}
+
+func (r *userRepository) FindByPasswordSetupToken(tokenHash string) (*User, error) {
+    var user User
+    err := r.db.Where("password_setup_token_hash = ? AND password_setup_token_hash <> ''", tokenHash).
+        First(&user).Error
+    return &user, err
+}